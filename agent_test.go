@@ -0,0 +1,58 @@
+package weyoun
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// TestMain serves an in-process ssh-agent holding a throwaway key so the
+// suite doesn't depend on the caller's SSH_AUTH_SOCK
+func TestMain(m *testing.M) {
+	os.Exit(func() int {
+		dir, err := ioutil.TempDir("", "weyoun-agent")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "TempDir", err)
+			return 1
+		}
+		defer os.RemoveAll(dir)
+
+		socket := filepath.Join(dir, "agent.sock")
+		listener, err := net.Listen("unix", socket)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Listen", err)
+			return 1
+		}
+		defer listener.Close()
+
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "GenerateKey", err)
+			return 1
+		}
+		keyring := agent.NewKeyring()
+		if err := keyring.Add(agent.AddedKey{PrivateKey: priv, Comment: "weyoun test"}); err != nil {
+			fmt.Fprintln(os.Stderr, "keyring.Add", err)
+			return 1
+		}
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go agent.ServeAgent(keyring, conn)
+			}
+		}()
+
+		os.Setenv("SSH_AUTH_SOCK", socket)
+		return m.Run()
+	}())
+}
@@ -0,0 +1,91 @@
+package weyoun
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"jonwillia.ms/weyoun/pkg/handlers"
+)
+
+// Capabilities2TXTRecords announces the protocol revision and the
+// channel types a server serves, a record per type
+func Capabilities2TXTRecords(caps handlers.Capabilities) []string {
+	result := []string{textRecord(keyProto, strconv.FormatUint(uint64(caps.Proto), 10))}
+	for _, c := range caps.Strings() {
+		result = append(result, textRecord(keyCaps, c))
+	}
+	return result
+}
+
+// TXTRecords2Capabilities reads the records of Capabilities2TXTRecords,
+// a server predating them has a zero Proto. The records aren't signed,
+// QueryCapabilities asks the server itself.
+func TXTRecords2Capabilities(txt []string) handlers.Capabilities {
+	caps := handlers.Capabilities{Channels: map[string]uint32{}}
+	for _, s := range txt {
+		bits := strings.SplitN(s, "=", 2)
+		if len(bits) != 2 {
+			continue
+		}
+		k, v := bits[0], bits[1]
+		switch k {
+		case keyProto:
+			if proto, err := strconv.ParseUint(v, 10, 32); err == nil {
+				caps.Proto = uint32(proto)
+			}
+		case keyCaps:
+			// a malformed capability is one we don't know how to use
+			caps.AddString(v)
+		}
+	}
+	return caps
+}
+
+// QueryCapabilities asks the server behind sshClient which channel types
+// the client may open. If ctx ends first the request is left waiting
+// until sshClient is closed.
+func QueryCapabilities(ctx context.Context, sshClient *ssh.Client) (handlers.Capabilities, error) {
+	type result struct {
+		ok    bool
+		reply []byte
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		ok, reply, err := sshClient.SendRequest(handlers.CapabilitiesRequest, true, nil)
+		done <- result{ok, reply, err}
+	}()
+	var r result
+	select {
+	case r = <-done:
+	case <-ctx.Done():
+		r.err = ctx.Err()
+	}
+	if r.err != nil {
+		return handlers.Capabilities{}, fmt.Errorf("failed to query capabilities: %w", r.err)
+	}
+	if !r.ok {
+		return handlers.Capabilities{}, fmt.Errorf("server doesn't announce capabilities")
+	}
+	return handlers.ParseCapabilities(r.reply)
+}
+
+// capable reports whether caps has every capability in required, as
+// formatted by handlers.Capabilities.Strings
+func capable(caps handlers.Capabilities, required []string) (bool, error) {
+	for _, r := range required {
+		want := handlers.Capabilities{}
+		if err := want.AddString(r); err != nil {
+			return false, err
+		}
+		for ct, v := range want.Channels {
+			if !caps.Has(ct, v) {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,209 @@
+package weyoun
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"jonwillia.ms/weyoun/pkg/client"
+	"jonwillia.ms/weyoun/pkg/handlers"
+	"jonwillia.ms/weyoun/pkg/pipenet"
+)
+
+func TestCapabilities(t *testing.T) {
+	const svcName = "caps"
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	network := pipenet.New()
+	discovery := NewMemoryDiscovery()
+	opts := []Option{
+		WithDiscovery(discovery),
+		WithListen(network.Listen),
+		WithDial(network.DialContext),
+	}
+	rpc := client.NewServer()
+	server := NewServer(svcName, handlers.Handlers{
+		Channels: map[string]handlers.ChannelHandler{
+			client.ChannelName(): rpc.ServeChannel,
+			"admin":              rpc.ServeChannel,
+		},
+		Versions: map[string]uint32{client.ChannelName(): client.ProtocolVersion},
+		Policy: &handlers.Policy{Channels: map[string]handlers.ChannelRule{
+			"admin": {Fingerprints: []string{"SHA256:nobody"}},
+		}},
+	}, opts...)
+	if err := server.Run(ctx); err != nil {
+		t.Fatalf("server.Run %v", err)
+	}
+
+	// too new a protocol filters the server out
+	picky := NewClient(svcName, func(ctx context.Context, sshClient *ssh.Client) {
+		t.Error("dialed a peer lacking capabilities")
+	}, func(_ context.Context, _ *ssh.Client) {}, nil,
+		append(opts, WithCapabilities(client.ChannelName()+"/99"))...)
+	if err := picky.Run(ctx); err != nil {
+		t.Fatalf("client.Run %v", err)
+	}
+
+	done := make(chan struct{})
+	c := NewClient(svcName, func(ctx context.Context, sshClient *ssh.Client) {
+		defer close(done)
+		caps, err := QueryCapabilities(ctx, sshClient)
+		if err != nil {
+			t.Errorf("QueryCapabilities %v", err)
+			return
+		}
+		if caps.Proto != handlers.ProtoVersion || !caps.Has(client.ChannelName(), client.ProtocolVersion) {
+			t.Errorf("QueryCapabilities = %+v", caps)
+		}
+		if caps.Has("admin", 0) {
+			t.Error("QueryCapabilities offered a channel denied by policy")
+		}
+	}, func(_ context.Context, _ *ssh.Client) {}, nil,
+		append(opts, WithCapabilities(client.ChannelName()+"/1"))...)
+	if err := c.Run(ctx); err != nil {
+		t.Fatalf("client.Run %v", err)
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+		t.Fatal("client handler never ran")
+	}
+
+	peers := c.Peers()
+	if len(peers) != 1 || !peers[0].Capabilities.Has("admin", 0) {
+		t.Errorf("Peers() = %+v, want announced admin capability", peers)
+	}
+	if peers := picky.Peers(); len(peers) != 0 {
+		t.Errorf("picky Peers() = %+v", peers)
+	}
+}
+
+// configuredDiscovery passes on the peers of a MemoryDiscovery as if
+// they came from local configuration, without their announced records
+type configuredDiscovery struct {
+	*MemoryDiscovery
+}
+
+func (d configuredDiscovery) Browse(ctx context.Context, service string) (<-chan *Peer, error) {
+	peers, err := d.MemoryDiscovery.Browse(ctx, service)
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan *Peer)
+	go func() {
+		defer close(out)
+		for peer := range peers {
+			configured := *peer
+			configured.Text = []string{textRecord(keyUniq, uniq(peer.Text))}
+			configured.Trusted = true
+			select {
+			case out <- &configured:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+func TestCapabilitiesConfiguredPeers(t *testing.T) {
+	const svcName = "configured-caps"
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	network := pipenet.New()
+	discovery := NewMemoryDiscovery()
+	rpc := client.NewServer()
+	server := NewServer(svcName, handlers.Handlers{
+		Channels: map[string]handlers.ChannelHandler{client.ChannelName(): rpc.ServeChannel},
+		Versions: map[string]uint32{client.ChannelName(): client.ProtocolVersion},
+	}, WithDiscovery(discovery), WithListen(network.Listen), WithDial(network.DialContext))
+	if err := server.Run(ctx); err != nil {
+		t.Fatalf("server.Run %v", err)
+	}
+
+	opts := []Option{
+		WithDiscovery(configuredDiscovery{discovery}),
+		WithDial(network.DialContext),
+	}
+	picky := NewClient(svcName, func(ctx context.Context, sshClient *ssh.Client) {
+		t.Error("handed over a configured peer lacking capabilities")
+	}, func(_ context.Context, _ *ssh.Client) {}, nil,
+		append(opts, WithCapabilities(client.ChannelName()+"/99"))...)
+	if err := picky.Run(ctx); err != nil {
+		t.Fatalf("client.Run %v", err)
+	}
+
+	done := make(chan struct{})
+	c := NewClient(svcName, func(ctx context.Context, sshClient *ssh.Client) {
+		close(done)
+	}, func(_ context.Context, _ *ssh.Client) {}, nil,
+		append(opts, WithCapabilities(client.ChannelName()+"/1"))...)
+	if err := c.Run(ctx); err != nil {
+		t.Fatalf("client.Run %v", err)
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+		t.Fatal("client handler never ran")
+	}
+	for _, peer := range picky.Peers() {
+		if peer.State == PeerConnected {
+			t.Errorf("picky client connected to %+v", peer)
+		}
+	}
+}
+
+func TestQueryCapabilitiesTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	network := pipenet.New()
+	l, err := network.Listen(ctx)
+	if err != nil {
+		t.Fatalf("Listen %v", err)
+	}
+	defer l.Close()
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(newSigner(t))
+	go func() {
+		serverConn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer serverConn.Close()
+		_, chans, reqs, err := ssh.NewServerConn(serverConn, config)
+		if err != nil {
+			return
+		}
+		go func() {
+			for range chans {
+			}
+		}()
+		// never answer, like a peer that has hung
+		for range reqs {
+		}
+	}()
+	clientConn, err := network.DialContext(ctx, "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial %v", err)
+	}
+	conn, chans, reqs, err := ssh.NewClientConn(clientConn, "pipe", &ssh.ClientConfig{
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn %v", err)
+	}
+	sshClient := ssh.NewClient(conn, chans, reqs)
+	defer sshClient.Close()
+
+	queryCtx, queryCancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer queryCancel()
+	if _, err := QueryCapabilities(queryCtx, sshClient); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("QueryCapabilities err=%v, want deadline exceeded", err)
+	}
+}
@@ -0,0 +1,54 @@
+package weyoun
+
+import (
+	"context"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"jonwillia.ms/weyoun/pkg/client"
+	"jonwillia.ms/weyoun/pkg/handlers"
+	"jonwillia.ms/weyoun/pkg/pipenet"
+)
+
+func TestChannelRequests(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	h := handlers.Handlers{
+		Channels: map[string]handlers.ChannelHandler{
+			client.ChannelName(): func(ctx context.Context, channel ssh.Channel, reqs <-chan *ssh.Request, extra []byte) {
+				// answers the client's hello
+				go client.NewServer().Serve(ctx, channel, extra)
+				for req := range reqs {
+					req.Reply(req.Type == "ping", nil)
+					if req.Type == "ping" {
+						channel.SendRequest("ack", false, req.Payload)
+					}
+				}
+			},
+		},
+	}
+
+	connectPair(ctx, t, pipenet.New(), h, func(ctx context.Context, sshClient *ssh.Client) {
+		weyoun, err := client.NewClient(sshClient)
+		if err != nil {
+			t.Errorf("client.NewClient %v", err)
+			return
+		}
+		defer weyoun.Close()
+		if ok, err := weyoun.SendRequest("ping", true, []byte("1")); !ok || err != nil {
+			t.Errorf("SendRequest ping = %v, %v", ok, err)
+		}
+		if ok, err := weyoun.SendRequest("unknown", true, nil); ok || err != nil {
+			t.Errorf("SendRequest unknown = %v, %v", ok, err)
+		}
+		select {
+		case req := <-weyoun.Requests():
+			if req.Type != "ack" || string(req.Payload) != "1" {
+				t.Errorf("unexpected request %s %q", req.Type, req.Payload)
+			}
+		case <-ctx.Done():
+			t.Error("no ack")
+		}
+	})
+}
@@ -4,8 +4,8 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"time"
 
-	"github.com/grandcat/zeroconf"
 	"github.com/rs/zerolog/log"
 	"golang.org/x/crypto/ssh"
 	"jonwillia.ms/weyoun/internal/hostkey"
@@ -14,21 +14,26 @@ import (
 type Client struct {
 	serviceName                 string
 	runOnce                     sync.Once
-	serviceEntries              <-chan *zeroconf.ServiceEntry
+	peerEntries                 <-chan *Peer
 	clientHandler, closeHandler func(context.Context, *ssh.Client)
 	instanceBlacklist           []string
+	peers                       *PeerSet
+	cfg                         Config
 }
 
 func NewClient(serviceName string,
 	clientHandler,
 	closeHandler func(context.Context, *ssh.Client),
 	instanceBlacklist []string,
+	opts ...Option,
 ) *Client {
 	return &Client{
 		serviceName:       serviceName,
 		clientHandler:     clientHandler,
 		closeHandler:      closeHandler,
 		instanceBlacklist: instanceBlacklist,
+		peers:             NewPeerSet(),
+		cfg:               newConfig(opts),
 	}
 }
 
@@ -39,7 +44,7 @@ func (c *Client) Run(ctx context.Context,
 	if !ok {
 		return fmt.Errorf("already Run()")
 	}
-	c.serviceEntries, err = Locator(ctx, c.serviceName, c.instanceBlacklist)
+	c.peerEntries, err = locator(ctx, c.cfg, c.serviceName, c.instanceBlacklist)
 	if err != nil {
 		return err
 	}
@@ -49,7 +54,12 @@ func (c *Client) Run(ctx context.Context,
 }
 
 func (c *Client) ListPublic() ([]ssh.PublicKey, error) {
-	return hostkey.ListPublic()
+	return hostkey.PublicKeys(c.cfg.KeySource, c.cfg.KeyPolicy)
+}
+
+// Peers returns a snapshot of the peers seen so far
+func (c *Client) Peers() []PeerStatus {
+	return c.peers.Snapshot()
 }
 
 func (c *Client) eventLoop(ctx context.Context) {
@@ -57,26 +67,100 @@ func (c *Client) eventLoop(ctx context.Context) {
 		select {
 		case <-ctx.Done():
 			return
-		case svc := <-c.serviceEntries: // TODO maintain service entry map
-			dialers, err := Dialers(ctx, svc)
-			if err != nil {
-				log.Print("Failed to get dialers: ", err)
+		case peer := <-c.peerEntries:
+			if peer == nil {
+				return
+			}
+			id, dial := c.peers.Observe(peer, time.Now())
+			if !dial {
+				log.Debug().Str("instance", peer.Instance).Str("id", id).
+					Msg("already connected")
 				continue
 			}
-			for _, dialer := range dialers {
-				sshClient, err := dialer(ctx)
-				if err != nil {
-					log.Warn().Err(err).Str("instance", svc.Instance).
-						Msg("Failed to dial")
-					continue
+			c.peers.SetState(id, PeerConnecting, nil)
+			sshClient, err := c.dial(ctx, peer)
+			if err != nil {
+				log.Warn().Err(err).Str("instance", peer.Instance).
+					Msg("Failed to connect")
+				c.peers.SetState(id, PeerDisconnected, nil)
+				// configured peers aren't sent again, keep trying them
+				if peer.Trusted {
+					go c.reconnect(ctx, id)
 				}
-				go c.clientHandler(ctx, sshClient)
-				go func() {
-					sshClient.Wait()
-					c.closeHandler(ctx, sshClient)
-				}()
-				break // one service entry found
+				continue
 			}
+			c.serve(ctx, id, sshClient)
+		}
+	}
+}
+
+// dial races the addresses of peer against each other
+func (c *Client) dial(ctx context.Context, peer *Peer) (*ssh.Client, error) {
+	sshClient, err := DialRace(ctx, dialersFor(peer, c.cfg), c.cfg.DialStagger)
+	if err != nil || !peer.Trusted || len(c.cfg.Capabilities) == 0 {
+		return sshClient, err
+	}
+	// configured peers announce nothing so the locator let them through,
+	// a peer that never answers mustn't hold up the event loop
+	queryCtx, cancel := context.WithCancel(ctx)
+	if c.cfg.Timeout > 0 {
+		queryCtx, cancel = context.WithTimeout(ctx, c.cfg.Timeout)
+	}
+	defer cancel()
+	caps, err := QueryCapabilities(queryCtx, sshClient)
+	if err == nil {
+		var ok bool
+		if ok, err = capable(caps, c.cfg.Capabilities); err == nil && !ok {
+			err = fmt.Errorf("peer lacks capabilities %v", c.cfg.Capabilities)
+		}
+	}
+	if err != nil {
+		sshClient.Close()
+		return nil, err
+	}
+	return sshClient, nil
+}
+
+func (c *Client) serve(ctx context.Context, id string, sshClient *ssh.Client) {
+	c.peers.SetState(id, PeerConnected, sshClient)
+	go c.clientHandler(ctx, sshClient)
+	go func() {
+		sshClient.Wait()
+		c.closeHandler(ctx, sshClient)
+		c.reconnect(ctx, id)
+	}()
+}
+
+// reconnect redials a dropped peer with backoff until it succeeds,
+// the policy gives up or ctx is done. Configured peers go by
+// ConfiguredMaxAttempts.
+func (c *Client) reconnect(ctx context.Context, id string) {
+	policy := c.cfg.ReconnectPolicy
+	if peer := c.peers.peer(id); peer != nil && peer.Trusted {
+		policy.MaxAttempts = policy.ConfiguredMaxAttempts
+	}
+	c.peers.SetState(id, PeerConnecting, nil)
+	for attempt := 0; !policy.GiveUp(attempt); attempt++ {
+		select {
+		case <-ctx.Done():
+			c.peers.SetState(id, PeerDisconnected, nil)
+			return
+		case <-time.After(policy.Backoff(attempt)):
+		}
+		peer := c.peers.peer(id)
+		if peer == nil {
+			break
+		}
+		sshClient, err := c.dial(ctx, peer)
+		if err != nil {
+			log.Warn().Err(err).Str("instance", peer.Instance).Int("attempt", attempt).
+				Msg("Failed to reconnect")
+			continue
 		}
+		log.Info().Str("instance", peer.Instance).Int("attempt", attempt).Msg("reconnected")
+		c.serve(ctx, id, sshClient)
+		return
 	}
+	log.Warn().Str("id", id).Msg("giving up on reconnecting")
+	c.peers.SetState(id, PeerDisconnected, nil)
 }
@@ -2,80 +2,132 @@ package weyoun
 
 import (
 	"context"
-	"fmt"
-	"io"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
 	"net"
 	"net/http"
-	"sync"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"golang.org/x/crypto/ssh"
 	"jonwillia.ms/weyoun/pkg/handlers"
+	"jonwillia.ms/weyoun/pkg/pipenet"
 )
 
 func TestClient(t *testing.T) {
-	const svcName = "something"
-	const dialAddr = "127.0.0.1:9999"
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
-	serverOK2 := false
-	go func() {
-		http.ListenAndServe(dialAddr, http.HandlerFunc(
-			func(rw http.ResponseWriter, r *http.Request) {
-				serverOK2 = true
-			},
-		))
-	}()
+	network := pipenet.New()
+	httpListener, err := network.Listen(ctx)
+	if err != nil {
+		t.Fatalf("Listen %v", err)
+	}
+	defer httpListener.Close()
+	serverOK2 := make(chan struct{})
+	go http.Serve(httpListener, http.HandlerFunc(
+		func(rw http.ResponseWriter, r *http.Request) {
+			close(serverOK2)
+		},
+	))
+
+	serverOK := make(chan struct{})
+	proxy := handlers.DirectTCPIPProxy(&handlers.ProxyPolicy{
+		Allow: []string{"127.0.0.0/8:*"},
+		Dial:  network.DialContext,
+	})
+	h := handlers.Handlers{OpenDirect: func(ctx context.Context, channel ssh.Channel, msg handlers.ChannelOpenDirectMsg) {
+		close(serverOK)
+		if peer, ok := handlers.PeerInfoFromContext(ctx); !ok || peer.Fingerprint == "" || peer.RemoteAddr == nil {
+			t.Errorf("no peer info in handler context: %+v", peer)
+		}
+		proxy(ctx, channel, msg)
+	}}
 
-	serverOK := false
-	server := NewServer(svcName, handlers.Handlers{OpenDirect: func(ctx context.Context, channel ssh.Channel, msg handlers.ChannelOpenDirectMsg) {
-		serverOK = true
-		conn, err := net.Dial("tcp", dialAddr)
+	ok := make(chan struct{})
+	connectPair(ctx, t, network, h, func(c context.Context, client *ssh.Client) {
+		rt := &http.Transport{Dial: func(network, addr string) (net.Conn, error) {
+			return client.Dial(network, addr)
+		}}
+		httpClient := http.Client{Transport: rt}
+		resp, err := httpClient.Get("http://" + httpListener.Addr().String() + "/")
 		if err != nil {
-			fmt.Println("dial error", err)
+			t.Errorf("get %v", err)
 			return
 		}
-		defer conn.Close()
-		var wg sync.WaitGroup
-		wg.Add(2)
-		go func() {
-			defer wg.Done()
-			io.Copy(channel, conn)
-		}()
-		go func() {
-			defer wg.Done()
-			io.Copy(conn, channel)
-		}()
-		wg.Wait()
-	}})
+		resp.Body.Close()
+		close(ok)
+	})
 
-	ok := false
-	client := NewClient(svcName, func(c context.Context, client *ssh.Client) {
-		ok = true
-		rt := &http.Transport{Dial: client.Dial}
-		httpClient := http.Client{Transport: rt}
-		resp, err := httpClient.Get("http://www.example.com/")
-		fmt.Println("get", resp, err)
-	}, func(_ context.Context, _ *ssh.Client) {}, nil)
+	for name, c := range map[string]chan struct{}{"ok": ok, "serverOK": serverOK, "serverOK2": serverOK2} {
+		select {
+		case <-c:
+		case <-ctx.Done():
+			t.Fatalf("!%s", name)
+		}
+	}
+}
+
+func TestClientCertAuthority(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	err := client.Run(ctx)
+	dir, err := ioutil.TempDir("", "weyoun-ca")
 	if err != nil {
-		t.Fatalf("client.Run %v", err)
+		t.Fatalf("TempDir %v", err)
 	}
-	err = server.Run(ctx)
+	defer os.RemoveAll(dir)
+
+	_, caPriv, err := ed25519.GenerateKey(rand.Reader)
 	if err != nil {
-		t.Fatalf("server.Run %v", err)
+		t.Fatalf("GenerateKey %v", err)
 	}
-
-	<-ctx.Done()
-	if !ok {
-		t.Fatalf("!ok")
+	caSigner, err := ssh.NewSignerFromKey(caPriv)
+	if err != nil {
+		t.Fatalf("NewSignerFromKey %v", err)
 	}
-	if !serverOK {
-		t.Fatalf("!serverOK")
+	sign := func(key ssh.PublicKey, certType uint32, principal string) *ssh.Certificate {
+		cert := &ssh.Certificate{
+			Key:             key,
+			CertType:        certType,
+			KeyId:           principal,
+			ValidPrincipals: []string{principal},
+			ValidBefore:     ssh.CertTimeInfinity,
+		}
+		if err := cert.SignCert(rand.Reader, caSigner); err != nil {
+			t.Fatalf("SignCert %v", err)
+		}
+		return cert
 	}
-	if !serverOK2 {
-		t.Fatalf("!serverOK2")
+
+	// the server's host key is trusted only through its certificate and
+	// the client's agent key only through its user certificate
+	hostKeys := GeneratedHostKey{Path: filepath.Join(dir, "host_key")}
+	hostSigners, err := hostKeys.Signers()
+	if err != nil {
+		t.Fatalf("hostKeys.Signers %v", err)
 	}
+	userKeys, err := AgentKeys{}.Signers()
+	if err != nil {
+		t.Fatalf("AgentKeys.Signers %v", err)
+	}
+
+	connectPairWith(ctx, t, pipenet.New(), handlers.Handlers{}, func(context.Context, *ssh.Client) {},
+		[]Option{
+			WithKeySource(hostKeys),
+			WithCertAuthority(&CertAuthority{
+				UserCAs:        []ssh.PublicKey{caSigner.PublicKey()},
+				UserPrincipals: []string{"alice"},
+				Certificates:   []*ssh.Certificate{sign(hostSigners[0].PublicKey(), ssh.HostCert, "localhost")},
+			}),
+		},
+		[]Option{
+			WithCertAuthority(&CertAuthority{
+				HostCAs:      []ssh.PublicKey{caSigner.PublicKey()},
+				Certificates: []*ssh.Certificate{sign(userKeys[0].PublicKey(), ssh.UserCert, "alice")},
+			}),
+		},
+	)
 }
@@ -0,0 +1,162 @@
+package weyoun
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"jonwillia.ms/weyoun/internal/hostkey"
+)
+
+// Config holds the knobs shared by Client and Server
+type Config struct {
+	User             string        // ssh user name presented by Client
+	Timeout          time.Duration // tcp connect, ssh handshake and capability query timeout
+	Domain           string        // zeroconf domain
+	ListenAddr       string        // Server listen address, "" picks a port on all interfaces
+	UnauthMultiplier int           // unauthenticated connections allowed per GOMAXPROCS
+	KeyPolicy        *KeyPolicy    // which of our keys are used as host and client keys
+	ReconnectPolicy  ReconnectPolicy
+	DialStagger      time.Duration  // head start each address gets before the next is tried
+	Discovery        Discovery      // nil uses MDNS in Domain
+	KeySource        KeySource      // nil uses the ssh-agent
+	CertAuthority    *CertAuthority // nil trusts plain keys only
+	ReloadInterval   time.Duration  // how often Server asks the KeySource again, 0 disables, Server.Reload forces one
+	RevocationFile   string         // OpenSSH KRL or revoked fingerprints, reread with authorized_keys when a handshake sees either change
+	// Capabilities a peer must have before the clientHandler sees it, as
+	// channel type or type/version for that version or later. Discovered
+	// peers are checked against their TXT records before dialing,
+	// configured peers with QueryCapabilities once connected.
+	Capabilities []string
+	// Listen and Dial replace the tcp transport, e.g. with pipenet in tests
+	Listen func(ctx context.Context) (net.Listener, error)
+	Dial   func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// DefaultConfig returns the settings used when no Option is given
+func DefaultConfig() Config {
+	return Config{
+		User:             "pubkey-fp",
+		Timeout:          time.Second,
+		Domain:           "local.",
+		ListenAddr:       "",
+		UnauthMultiplier: 5,
+		// RSA keys are blacklisted because I can't figure out how to
+		// disallow YubiKey keys from my gpg/ssh-agent
+		KeyPolicy:       &KeyPolicy{DenyTypes: []string{"ssh-rsa"}},
+		ReconnectPolicy: DefaultReconnectPolicy,
+		DialStagger:     250 * time.Millisecond, // RFC 8305
+		ReloadInterval:  5 * time.Minute,        // each reload asks the agent, key files are checked per handshake
+	}
+}
+
+func (c Config) discovery() Discovery {
+	if c.Discovery != nil {
+		return c.Discovery
+	}
+	return &MDNS{Domain: c.Domain}
+}
+
+// revocations reads RevocationFile on every call so a revoked key is cut
+// off at the next handshake or dial
+func (c Config) revocations() (*hostkey.RevocationList, error) {
+	if c.RevocationFile == "" {
+		return nil, nil
+	}
+	return hostkey.ReadRevocationList(c.RevocationFile)
+}
+
+func (c Config) listen(ctx context.Context) (net.Listener, error) {
+	if c.Listen != nil {
+		return c.Listen(ctx)
+	}
+	lc := net.ListenConfig{}
+	return lc.Listen(ctx, "tcp", c.ListenAddr)
+}
+
+func (c Config) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if c.Dial != nil {
+		return c.Dial(ctx, network, addr)
+	}
+	dialer := net.Dialer{Timeout: c.Timeout}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+type Option func(*Config)
+
+func newConfig(opts []Option) Config {
+	cfg := DefaultConfig()
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// WithConfig replaces every setting at once
+func WithConfig(cfg Config) Option {
+	return func(c *Config) { *c = cfg }
+}
+
+func WithUser(user string) Option {
+	return func(c *Config) { c.User = user }
+}
+
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Config) { c.Timeout = timeout }
+}
+
+func WithDomain(domain string) Option {
+	return func(c *Config) { c.Domain = domain }
+}
+
+func WithListenAddr(addr string) Option {
+	return func(c *Config) { c.ListenAddr = addr }
+}
+
+func WithUnauthMultiplier(n int) Option {
+	return func(c *Config) { c.UnauthMultiplier = n }
+}
+
+func WithKeyPolicy(policy *KeyPolicy) Option {
+	return func(c *Config) { c.KeyPolicy = policy }
+}
+
+func WithReconnectPolicy(policy ReconnectPolicy) Option {
+	return func(c *Config) { c.ReconnectPolicy = policy }
+}
+
+func WithDialStagger(stagger time.Duration) Option {
+	return func(c *Config) { c.DialStagger = stagger }
+}
+
+func WithDiscovery(discovery Discovery) Option {
+	return func(c *Config) { c.Discovery = discovery }
+}
+
+func WithListen(listen func(ctx context.Context) (net.Listener, error)) Option {
+	return func(c *Config) { c.Listen = listen }
+}
+
+func WithDial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) Option {
+	return func(c *Config) { c.Dial = dial }
+}
+
+func WithKeySource(src KeySource) Option {
+	return func(c *Config) { c.KeySource = src }
+}
+
+func WithCertAuthority(ca *CertAuthority) Option {
+	return func(c *Config) { c.CertAuthority = ca }
+}
+
+func WithReloadInterval(interval time.Duration) Option {
+	return func(c *Config) { c.ReloadInterval = interval }
+}
+
+func WithRevocationFile(path string) Option {
+	return func(c *Config) { c.RevocationFile = path }
+}
+
+func WithCapabilities(caps ...string) Option {
+	return func(c *Config) { c.Capabilities = caps }
+}
@@ -9,15 +9,19 @@ import (
 
 	"github.com/rs/zerolog/log"
 
-	zeroconf "github.com/grandcat/zeroconf"
 	"golang.org/x/crypto/ssh"
 	"jonwillia.ms/weyoun/internal/hostkey"
+	"jonwillia.ms/weyoun/pkg/handlers"
 )
 
-func Locator(ctx context.Context, serviceName string, blacklistIDs []string) (<-chan *zeroconf.ServiceEntry, error) {
-	// for now only connect to services who publish a text record matching one of our signing keys
-	// TODO: ideally this would be a signed version of host + port with the key
-	myKeys, err := hostkey.Signers()
+func Locator(ctx context.Context, serviceName string, blacklistIDs []string) (<-chan *Peer, error) {
+	return locator(ctx, DefaultConfig(), serviceName, blacklistIDs)
+}
+
+func locator(ctx context.Context, cfg Config, serviceName string, blacklistIDs []string) (<-chan *Peer, error) {
+	// only connect to services who publish a text record matching one of our signing keys
+	// and a signature of instance + port + uniq made with one of our authorized keys
+	myKeys, err := hostkey.AllowedSigners(cfg.KeySource, cfg.KeyPolicy)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get user signers: %w", err)
 	}
@@ -28,93 +32,301 @@ func Locator(ctx context.Context, serviceName string, blacklistIDs []string) (<-
 				myKey.PublicKey(),
 			},
 		))
+		// or a CA that signed one of our user certificates
+		if cert := cfg.CertAuthority.Certificate(myKey.PublicKey(), ssh.UserCert); cert != nil {
+			matchers = append(matchers, append(PublicKeys2TXTRecords(nil),
+				CAs2TXTRecords([]ssh.PublicKey{cert.SignatureKey})...,
+			))
+		}
+	}
+
+	revoked, err := cfg.revocations()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := capable(handlers.Capabilities{}, cfg.Capabilities); err != nil {
+		return nil, err
 	}
 
 	antiMatchers := make([][]string, 0)
 	for _, blacklistID := range blacklistIDs {
 		antiMatchers = append(antiMatchers, []string{textRecord(keyUniq, blacklistID)})
 	}
+	for _, fp := range revoked.Fingerprints() {
+		antiMatchers = append(antiMatchers, []string{textRecord(keySsh, fp)})
+	}
+
+	authKeys, err := hostkey.GetAuthorizedKeys(cfg.KeySource, cfg.KeyPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get authorized keys: %w", err)
+	}
+	authKeys = revoked.Filter(authKeys)
 
-	return Locate(ctx, serviceName, matchers, antiMatchers)
+	peers, err := cfg.discovery().Browse(ctx, serviceName)
+	if err != nil {
+		return nil, err
+	}
+	output := make(chan *Peer)
+	go func() {
+		defer close(output)
+		for peer := range peers {
+			log.Debug().Str("Instance", peer.Instance).Msg("found")
+			if matchAny(peer.Text, antiMatchers) {
+				log.Debug().Str("Instance", peer.Instance).Msg("skipped")
+				continue
+			}
+			// configured peers announce nothing, Client.dial queries them
+			if ok, _ := capable(TXTRecords2Capabilities(peer.Text), cfg.Capabilities); !ok && !peer.Trusted {
+				log.Debug().Str("Instance", peer.Instance).Msg("lacks capabilities")
+				continue
+			}
+			if !peer.Trusted {
+				if !matchAny(peer.Text, matchers) {
+					continue
+				}
+				key, err := VerifyPeer(peer, authKeys, cfg.CertAuthority, time.Now())
+				if err != nil {
+					log.Warn().Err(err).Str("instance", peer.Instance).Msg("rejected unverified peer")
+					continue
+				}
+				if revoked.Revoked(key) {
+					log.Warn().Str("instance", peer.Instance).Msg("rejected peer signed by a revoked key")
+					continue
+				}
+			}
+			select {
+			case output <- peer:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return output, nil
+}
+
+// Dialers returns a dialer per address of peer, IPv6 and IPv4 interleaved
+func Dialers(ctx context.Context, peer *Peer) ([]func(ctx context.Context) (*ssh.Client, error), error) {
+	return dialersFor(peer, DefaultConfig()), nil
 }
 
-func Dialers(ctx context.Context, svc *zeroconf.ServiceEntry) ([]func(ctx context.Context) (*ssh.Client, error), error) {
-	host := ""
-	nilStringer := func(s fmt.Stringer) string {
-		if s == nil {
-			return ""
+func dialersFor(peer *Peer, cfg Config) []func(ctx context.Context) (*ssh.Client, error) {
+	dialers := make([]func(ctx context.Context) (*ssh.Client, error), 0)
+	for _, ip := range interleave(peer.AddrIPv6, peer.AddrIPv4) {
+		for _, host := range hostsFor(ip) {
+			dialers = append(dialers, dialerFor(host, peer, cfg))
 		}
-		return s.String()
 	}
-	addrStrings := []string{}
-	for _, addr := range append(svc.AddrIPv4, svc.AddrIPv6...) {
-		s := nilStringer(addr)
-		addrStrings = append(addrStrings, s)
+	if len(dialers) == 0 && peer.HostName != "" {
+		dialers = append(dialers, dialerFor(peer.HostName, peer, cfg))
 	}
-	dialers := make([]func(ctx context.Context) (*ssh.Client, error), 0)
+	return dialers
+}
 
-	for _, s := range addrStrings {
-		host = s
-		if host == "" {
+func interleave(a, b []net.IP) []net.IP {
+	out := make([]net.IP, 0, len(a)+len(b))
+	for i := 0; i < len(a) || i < len(b); i++ {
+		if i < len(a) {
+			out = append(out, a[i])
+		}
+		if i < len(b) {
+			out = append(out, b[i])
+		}
+	}
+	return out
+}
+
+// hostsFor zones IPv6 link-local addresses with every interface they
+// could be reachable on, since zeroconf doesn't report which one answered
+func hostsFor(ip net.IP) []string {
+	if len(ip) == 0 || ip.IsUnspecified() {
+		return nil
+	}
+	if ip.To4() != nil || !ip.IsLinkLocalUnicast() {
+		return []string{ip.String()}
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to list interfaces")
+		return nil
+	}
+	hosts := []string{}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 ||
+			iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
 			continue
 		}
-		dialers = append(dialers, dialerFor(host, svc))
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if ok && ipNet.IP.To4() == nil && ipNet.IP.IsLinkLocalUnicast() {
+				hosts = append(hosts, ip.String()+"%"+iface.Name)
+				break
+			}
+		}
+	}
+	return hosts
+}
+
+// DialRace starts the dialers in order staggered by delay, starting the
+// next one early when an attempt fails. The first client to complete
+// its handshake is returned and the other attempts are abandoned.
+func DialRace(ctx context.Context, dialers []func(ctx context.Context) (*ssh.Client, error), delay time.Duration) (*ssh.Client, error) {
+	if len(dialers) == 0 {
+		return nil, fmt.Errorf("no addresses to dial")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		client *ssh.Client
+		err    error
+	}
+	results := make(chan result, len(dialers))
+	next := 0
+	start := func() {
+		dialer := dialers[next]
+		next++
+		go func() {
+			client, err := dialer(ctx)
+			results <- result{client, err}
+		}()
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	resetTimer := func() {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(delay)
 	}
 
-	return dialers, nil
+	start()
+	var lastErr error
+	for pending := 1; pending > 0; {
+		select {
+		case <-timer.C:
+			if next < len(dialers) {
+				start()
+				pending++
+				timer.Reset(delay)
+			}
+		case r := <-results:
+			pending--
+			if r.err != nil {
+				lastErr = r.err
+				if next < len(dialers) {
+					start()
+					pending++
+					resetTimer()
+				}
+				continue
+			}
+			go func(pending int) {
+				for ; pending > 0; pending-- {
+					if r := <-results; r.client != nil {
+						r.client.Close()
+					}
+				}
+			}(pending)
+			return r.client, nil
+		}
+	}
+	return nil, lastErr
 }
 
-func dialerFor(host string, svc *zeroconf.ServiceEntry,
+func dialerFor(host string, peer *Peer, cfg Config,
 ) func(ctx context.Context) (*ssh.Client, error) {
 	return func(ctx context.Context) (*ssh.Client, error) {
-		addrStr := net.JoinHostPort(host, strconv.Itoa(svc.Port))
+		addrStr := net.JoinHostPort(host, strconv.Itoa(peer.Port))
 		log.Info().Str("addr", addrStr).Msg("Connecting")
 
-		remoteKeys, err := hostkey.GetAuthorizedKeys()
+		ca := cfg.CertAuthority
+		hostCA := ca != nil && len(ca.HostCAs) > 0
+
+		revoked, err := cfg.revocations()
+		if err != nil {
+			return nil, err
+		}
+		remoteKeys, err := hostkey.GetAuthorizedKeys(cfg.KeySource, cfg.KeyPolicy)
 		if err != nil {
 			return nil, err
 		}
-		if len(remoteKeys) == 0 {
+		remoteKeys = revoked.Filter(remoteKeys)
+		if len(remoteKeys) == 0 && !hostCA {
 			return nil, fmt.Errorf("no possible authorized keys")
 		}
 
-		zeroconfKeys := HostKeys(svc)
-		if len(zeroconfKeys) == 0 {
-			return nil, fmt.Errorf("no remote keys in zeroconf dns")
+		zeroconfKeys := parseTextRecord(peer.Text)
+		if !peer.Trusted {
+			// peer may be reused to reconnect, PeerSet keeps the latest
+			// announcement which the server re-signs every signatureRefresh
+			if _, err := VerifyPeer(peer, remoteKeys, ca, time.Now()); err != nil {
+				return nil, fmt.Errorf("failed to verify zeroconf signature: %w", err)
+			}
+			if len(zeroconfKeys) == 0 && !hostCA {
+				return nil, fmt.Errorf("no remote keys in zeroconf dns")
+			}
 		}
 
-		remoteKeys = hostkey.FilterKeys(remoteKeys, zeroconfKeys)
-		if len(remoteKeys) == 0 {
+		if len(zeroconfKeys) > 0 {
+			remoteKeys = hostkey.FilterKeys(remoteKeys, zeroconfKeys)
+		}
+		if len(remoteKeys) == 0 && !hostCA {
 			return nil, fmt.Errorf("no possible authorized keys in zeroconf dns")
 		}
 
-		hkcb, err := hostkey.GetHostKeyCallBack(remoteKeys)
+		hkcb, err := hostkey.GetHostKeyCallBack(remoteKeys, revoked)
 		if err != nil {
 			return nil, fmt.Errorf("failed to get host keys: %w", err)
 		}
+		hkcb = revoked.HostKeyCallback(ca.HostKeyCallback(hostPrincipals(peer), hkcb))
 
-		authMethod, err := hostkey.GetPublicKeysCallback()
+		authMethod, err := hostkey.GetPublicKeysCallback(cfg.KeySource, cfg.KeyPolicy, ca)
 		if err != nil {
 			return nil, fmt.Errorf("failed to get user keys: %w", err)
 		}
 
 		config := &ssh.ClientConfig{
-			User: "pubkey-fp", // TODO don't use this
+			User: cfg.User,
 			Auth: []ssh.AuthMethod{
 				authMethod,
 			},
 			HostKeyCallback: hkcb,
-			Timeout:         time.Second,
+			Timeout:         cfg.Timeout,
 		}
-		dialer := net.Dialer{}
-		conn, err := dialer.DialContext(ctx, "tcp", addrStr)
+		conn, err := cfg.dial(ctx, "tcp", addrStr)
 		if err != nil {
-			return nil, fmt.Errorf("net.Dialer.DialContext: %w", err)
+			return nil, fmt.Errorf("dial: %w", err)
+		}
+		if cfg.Timeout > 0 {
+			conn.SetDeadline(time.Now().Add(cfg.Timeout))
 		}
+		// abandon the handshake if ctx is cancelled before it completes
+		handshakeDone := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				select {
+				case <-handshakeDone:
+				default:
+					conn.Close()
+				}
+			case <-handshakeDone:
+			}
+		}()
 		sshConn, newChannelChan, reqs, err := ssh.NewClientConn(conn, addrStr, config)
+		close(handshakeDone)
 		if err != nil {
 			return nil, fmt.Errorf("ssh.NewClientConn: %w", err)
 		}
+		conn.SetDeadline(time.Time{})
 		return ssh.NewClient(sshConn, newChannelChan, reqs), nil
 	}
 }
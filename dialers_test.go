@@ -0,0 +1,64 @@
+package weyoun
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestDialRace(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cancelled := make(chan struct{})
+	want := new(ssh.Client)
+	dialers := []func(ctx context.Context) (*ssh.Client, error){
+		func(ctx context.Context) (*ssh.Client, error) {
+			<-ctx.Done()
+			close(cancelled)
+			return nil, ctx.Err()
+		},
+		func(ctx context.Context) (*ssh.Client, error) {
+			return nil, fmt.Errorf("refused")
+		},
+		func(ctx context.Context) (*ssh.Client, error) {
+			return want, nil
+		},
+	}
+	got, err := DialRace(ctx, dialers, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("DialRace %v", err)
+	}
+	if got != want {
+		t.Fatal("DialRace returned the wrong client")
+	}
+	select {
+	case <-cancelled:
+	case <-ctx.Done():
+		t.Fatal("slow dialer was not cancelled")
+	}
+
+	_, err = DialRace(ctx, dialers[1:2], time.Millisecond)
+	if err == nil {
+		t.Fatal("DialRace should fail when every dialer fails")
+	}
+}
+
+func TestInterleave(t *testing.T) {
+	v6 := []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")}
+	v4 := []net.IP{net.ParseIP("192.0.2.1")}
+	got := interleave(v6, v4)
+	want := []string{"2001:db8::1", "192.0.2.1", "2001:db8::2"}
+	if len(got) != len(want) {
+		t.Fatalf("len(got) != %d: %v", len(want), got)
+	}
+	for i := range want {
+		if got[i].String() != want[i] {
+			t.Fatalf("interleave()[%d] = %v want %v", i, got[i], want[i])
+		}
+	}
+}
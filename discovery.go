@@ -0,0 +1,80 @@
+package weyoun
+
+import (
+	"context"
+	"net"
+
+	zeroconf "github.com/grandcat/zeroconf"
+)
+
+// Peer is a service instance found by a Discovery backend
+type Peer struct {
+	Instance string
+	HostName string
+	Port     int
+	Text     []string
+	AddrIPv4 []net.IP
+	AddrIPv6 []net.IP
+	// Trusted is set by backends whose peers come from local configuration,
+	// their TXT records don't need to be signed or list our keys
+	Trusted bool
+}
+
+// Announcement is a published service whose TXT records can be updated
+type Announcement interface {
+	SetText(text []string)
+}
+
+// Discovery publishes and finds weyoun services
+type Discovery interface {
+	// Announce publishes the service until ctx is done
+	Announce(ctx context.Context, instance, service string, port int, text []string) (Announcement, error)
+	// Browse sends peers offering service until ctx is done
+	Browse(ctx context.Context, service string) (<-chan *Peer, error)
+}
+
+// MDNS is the default zeroconf backed Discovery
+type MDNS struct {
+	Domain string
+}
+
+func (m *MDNS) Announce(ctx context.Context, instance, service string, port int, text []string) (Announcement, error) {
+	return register(ctx, instance, service, m.domain(), port, text)
+}
+
+func (m *MDNS) Browse(ctx context.Context, service string) (<-chan *Peer, error) {
+	entries, err := locate(ctx, service, m.domain(), [][]string{{}}, nil)
+	if err != nil {
+		return nil, err
+	}
+	output := make(chan *Peer)
+	go func() {
+		defer close(output)
+		for svc := range entries {
+			select {
+			case output <- peerFromServiceEntry(svc):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return output, nil
+}
+
+func (m *MDNS) domain() string {
+	if m.Domain == "" {
+		return "local."
+	}
+	return m.Domain
+}
+
+func peerFromServiceEntry(svc *zeroconf.ServiceEntry) *Peer {
+	return &Peer{
+		Instance: svc.Instance,
+		HostName: svc.HostName,
+		Port:     svc.Port,
+		Text:     svc.Text,
+		AddrIPv4: svc.AddrIPv4,
+		AddrIPv6: svc.AddrIPv6,
+	}
+}
@@ -0,0 +1,47 @@
+package weyoun
+
+import (
+	"context"
+	"net"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+	"jonwillia.ms/weyoun/internal/pipe"
+)
+
+// ForwardRemote asks the server behind client to listen on remoteAddr
+// and connects every connection it accepts to a conn from dial, until
+// ctx is done. The returned address carries the port the server chose
+// when remoteAddr asks for port 0.
+func ForwardRemote(ctx context.Context, client *ssh.Client, remoteAddr string,
+	dial func(ctx context.Context) (net.Conn, error),
+) (net.Addr, error) {
+	l, err := client.Listen("tcp", remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	go func() {
+		defer l.Close()
+		for {
+			remote, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer remote.Close()
+				local, err := dial(ctx)
+				if err != nil {
+					log.Error().Err(err).Str("addr", remoteAddr).Msg("failed to dial forwarded connection")
+					return
+				}
+				defer local.Close()
+				pipe.Join(remote, local)
+			}()
+		}
+	}()
+	return l.Addr(), nil
+}
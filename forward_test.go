@@ -0,0 +1,77 @@
+package weyoun
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"jonwillia.ms/weyoun/pkg/handlers"
+	"jonwillia.ms/weyoun/pkg/pipenet"
+)
+
+func TestForwardRemote(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	network := pipenet.New()
+
+	// the client exposes an echo service on the server
+	echo, err := network.Listen(ctx)
+	if err != nil {
+		t.Fatalf("Listen %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	h := handlers.Handlers{
+		RemoteForward: &handlers.RemoteForward{
+			Listen: func(ctx context.Context, addr string) (net.Listener, error) {
+				return network.Listen(ctx)
+			},
+		},
+	}
+
+	var addr net.Addr
+	connectPair(ctx, t, network, h, func(ctx context.Context, client *ssh.Client) {
+		var err error
+		addr, err = ForwardRemote(ctx, client, "127.0.0.1:0", func(ctx context.Context) (net.Conn, error) {
+			return network.DialContext(ctx, "tcp", echo.Addr().String())
+		})
+		if err != nil {
+			t.Errorf("ForwardRemote %v", err)
+		}
+	})
+	if addr == nil {
+		t.Fatal("never forwarded")
+	}
+	port := addr.(*net.TCPAddr).Port
+	if port == 0 {
+		t.Fatal("server didn't report the forwarded port")
+	}
+	conn, err := network.DialContext(ctx, "tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("Dial %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("ReadFull %q %v", buf, err)
+	}
+}
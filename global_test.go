@@ -0,0 +1,63 @@
+package weyoun
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"jonwillia.ms/weyoun/pkg/handlers"
+	"jonwillia.ms/weyoun/pkg/pipenet"
+)
+
+func TestGlobalRequests(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	notified := make(chan string, 1)
+	h := handlers.Handlers{
+		Global: map[string]handlers.GlobalHandler{
+			"whoami@test": func(ctx context.Context, peer handlers.PeerInfo, payload []byte) (bool, []byte) {
+				return peer.Fingerprint != "", []byte(peer.Fingerprint)
+			},
+			"notify@test": func(ctx context.Context, peer handlers.PeerInfo, payload []byte) (bool, []byte) {
+				notified <- string(payload)
+				return true, nil
+			},
+			"admin@test": func(ctx context.Context, peer handlers.PeerInfo, payload []byte) (bool, []byte) {
+				t.Error("admin@test ran despite policy")
+				return true, nil
+			},
+		},
+		Policy: &handlers.Policy{Channels: map[string]handlers.ChannelRule{
+			"admin@test": {Fingerprints: []string{"SHA256:nobody"}},
+		}},
+	}
+
+	connectPair(ctx, t, pipenet.New(), h, func(ctx context.Context, sshClient *ssh.Client) {
+		ok, reply, err := sshClient.SendRequest("whoami@test", true, nil)
+		if err != nil || !ok || !strings.HasPrefix(string(reply), "SHA256:") {
+			t.Errorf("whoami = %v, %q, %v", ok, reply, err)
+		}
+		if ok, _, err := sshClient.SendRequest("keepalive@openssh.com", true, nil); !ok || err != nil {
+			t.Errorf("keepalive = %v, %v", ok, err)
+		}
+		if ok, _, err := sshClient.SendRequest("admin@test", true, nil); ok || err != nil {
+			t.Errorf("admin = %v, %v", ok, err)
+		}
+		if ok, _, err := sshClient.SendRequest("unknown@test", true, nil); ok || err != nil {
+			t.Errorf("unknown = %v, %v", ok, err)
+		}
+		if _, _, err := sshClient.SendRequest("notify@test", false, []byte("hi")); err != nil {
+			t.Errorf("notify %v", err)
+		}
+		select {
+		case got := <-notified:
+			if got != "hi" {
+				t.Errorf("notify payload %q", got)
+			}
+		case <-ctx.Done():
+			t.Error("notify never handled")
+		}
+	})
+}
@@ -5,6 +5,7 @@ go 1.16
 require (
 	github.com/google/uuid v1.2.0
 	github.com/grandcat/zeroconf v1.0.0
+	github.com/pkg/sftp v1.13.0
 	github.com/rs/zerolog v1.22.0
 	golang.org/x/crypto v0.0.0-20210513164829-c07d793c2f9a
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
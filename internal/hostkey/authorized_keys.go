@@ -3,72 +3,116 @@ package hostkey
 import (
 	"fmt"
 	"io/ioutil"
+	"os"
 	"os/user"
+	"time"
 
+	"github.com/rs/zerolog/log"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 )
 
-func GetAuthorizedKeys() ([]ssh.PublicKey, error) {
+// GetAuthorizedKeys returns every key in ~/.ssh/authorized_keys and the
+// public halves of src that pass policy
+func GetAuthorizedKeys(src KeySource, policy *KeyPolicy) ([]ssh.PublicKey, error) {
+	entries, err := getAuthorizedKeyEntries(src, policy)
+	if err != nil {
+		return nil, err
+	}
+	authorizedKeys := make([]ssh.PublicKey, 0, len(entries))
+	for _, entry := range entries {
+		authorizedKeys = append(authorizedKeys, entry.key)
+	}
+	return authorizedKeys, nil
+}
+
+type authorizedKey struct {
+	key     ssh.PublicKey
+	options []string
+}
+
+// AuthorizedKeysPath is the authorized_keys file of the current user
+func AuthorizedKeysPath() (string, error) {
 	usr, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return usr.HomeDir + "/.ssh/authorized_keys", nil
+}
+
+func getAuthorizedKeyEntries(src KeySource, policy *KeyPolicy) ([]authorizedKey, error) {
+	authorizedKeysPath, err := AuthorizedKeysPath()
 	if err != nil {
 		return nil, err
 	}
-	authorizedKeysPath := usr.HomeDir + "/.ssh/authorized_keys"
 
 	// Public key authentication is done by comparing
 	// the public key of a received connection
 	// with the entries in the authorized_keys file.
+	// Like sshd a missing file authorizes no extra keys rather than
+	// failing, our own keys are still authorized so peers sharing an
+	// agent or GeneratedSource keys work on a fresh account.
 	authorizedKeysBytes, err := ioutil.ReadFile(authorizedKeysPath)
-	if err != nil {
+	if os.IsNotExist(err) {
+		log.Debug().Str("path", authorizedKeysPath).Msg("no authorized_keys, only our own keys are authorized")
+	} else if err != nil {
 		return nil, fmt.Errorf("Failed to load authorized_keys: %w", err)
 	}
-	agentKeys, err := List()
+	ownKeys, err := PublicKeys(src, policy)
 	if err != nil {
 		return nil, err
 	}
 
-	authorizedKeys := []ssh.PublicKey{}
+	authorizedKeys := []authorizedKey{}
 	for len(authorizedKeysBytes) > 0 {
-		pubKey, _, _, rest, err := ssh.ParseAuthorizedKey(authorizedKeysBytes)
+		// policy is about our own keys, authorized_keys is taken as is
+		pubKey, _, options, rest, err := ssh.ParseAuthorizedKey(authorizedKeysBytes)
 		if err != nil {
 			return nil, err
 		}
-
-		authorizedKeys = append(authorizedKeys, pubKey)
 		authorizedKeysBytes = rest
+
+		authorizedKeys = append(authorizedKeys, authorizedKey{pubKey, options})
 	}
 
-	for _, pubKey := range agentKeys {
-		authorizedKeys = append(authorizedKeys, pubKey)
+	for _, pubKey := range ownKeys {
+		authorizedKeys = append(authorizedKeys, authorizedKey{key: pubKey})
 	}
 
 	return authorizedKeys, nil
 }
 
-func GetAuthorizedKeysCallback() (func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error), error) {
-	authorizedKeys, err := GetAuthorizedKeys()
+// GetAuthorizedKeysCallback accepts the keys of GetAuthorizedKeys that
+// aren't revoked
+func GetAuthorizedKeysCallback(src KeySource, policy *KeyPolicy, revoked *RevocationList) (func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error), error) {
+	authorizedKeys, err := getAuthorizedKeyEntries(src, policy)
 	if err != nil {
 		return nil, err
 	}
 
-	authorizedKeysMap := map[string]bool{}
-	for _, pubKey := range authorizedKeys {
-		authorizedKeysMap[string(pubKey.Marshal())] = true
+	// like sshd the first line for a key wins
+	authorizedKeysMap := map[string][]string{}
+	for _, entry := range authorizedKeys {
+		k := string(entry.key.Marshal())
+		if _, ok := authorizedKeysMap[k]; !ok {
+			authorizedKeysMap[k] = entry.options
+		}
 	}
 
-	return func(c ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
-		if authorizedKeysMap[string(pubKey.Marshal())] {
-			return &ssh.Permissions{
-				// Record the public key used for authentication.
-				Extensions: map[string]string{
-					"pubkey-fp":   ssh.FingerprintSHA256(pubKey),
-					"pubkey-type": pubKey.Type(),
-				},
-			}, nil
+	return revoked.UserCallback(func(c ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
+		options, ok := authorizedKeysMap[string(pubKey.Marshal())]
+		if !ok {
+			return nil, fmt.Errorf("unknown public key for %q, fp=%+v", c.User(), ssh.FingerprintSHA256(pubKey))
 		}
-		return nil, fmt.Errorf("unknown public key for %q, fp=%+v", c.User(), ssh.FingerprintSHA256(pubKey))
-	}, nil
+		perms, err := optionsPermissions(options, c, time.Now())
+		if err != nil {
+			return nil, fmt.Errorf("rejected key for %q, fp=%+v: %w", c.User(), ssh.FingerprintSHA256(pubKey), err)
+		}
+		// Record the public key used for authentication.
+		perms.Extensions["pubkey-fp"] = ssh.FingerprintSHA256(pubKey)
+		perms.Extensions["pubkey-type"] = pubKey.Type()
+		return perms, nil
+	}), nil
 }
 
 func List() ([]*agent.Key, error) {
@@ -84,14 +128,6 @@ func List() ([]*agent.Key, error) {
 	return agentKeys, nil
 }
 
-func ListPublic() ([]ssh.PublicKey, error) {
-	keys, err := List()
-	pkeys := make([]ssh.PublicKey, 0, len(keys))
-	if err != nil {
-		return nil, err
-	}
-	for _, key := range keys {
-		pkeys = append(pkeys, key)
-	}
-	return pkeys, nil
+func ListPublic(src KeySource) ([]ssh.PublicKey, error) {
+	return PublicKeys(src, nil)
 }
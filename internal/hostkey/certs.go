@@ -0,0 +1,209 @@
+package hostkey
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// CertPermitPortForwarding is the certificate extension allowing local
+// and remote port forwarding
+const CertPermitPortForwarding = "permit-port-forwarding"
+
+// CertAuthority configures trust in OpenSSH certificates signed by a team CA
+type CertAuthority struct {
+	UserCAs []ssh.PublicKey // trusted to sign user certificates
+	HostCAs []ssh.PublicKey // trusted to sign host certificates
+	// UserPrincipals lists the principals accepted in user certificates,
+	// when empty the certificate must be valid for the ssh user name
+	UserPrincipals []string
+	// CriticalOptions understood besides source-address, certificates
+	// carrying any other critical option are rejected
+	CriticalOptions []string
+	// Certificates are our own user and host certificates, matched to
+	// the signers of the KeySource by public key
+	Certificates []*ssh.Certificate
+}
+
+func (ca *CertAuthority) checker() *ssh.CertChecker {
+	return &ssh.CertChecker{SupportedCriticalOptions: ca.CriticalOptions}
+}
+
+// checkCert checks cert was signed by one of cas and is valid for one of
+// the principals
+func (ca *CertAuthority) checkCert(cert *ssh.Certificate, certType uint32, cas []ssh.PublicKey, principals []string) error {
+	if cert.CertType != certType {
+		return fmt.Errorf("certificate has type %d", cert.CertType)
+	}
+	if !containsKey(cas, cert.SignatureKey) {
+		return fmt.Errorf("certificate signed by unrecognized authority %s", ssh.FingerprintSHA256(cert.SignatureKey))
+	}
+	err := fmt.Errorf("no principals to check")
+	for _, principal := range principals {
+		if err = ca.checker().CheckCert(principal, cert); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// UserCallback accepts user certificates signed by UserCAs and hands
+// plain keys to fallback
+func (ca *CertAuthority) UserCallback(
+	fallback func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error),
+) func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	// only a verified certificate may set cert-key-id and cert-principals
+	plain := func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		perms, err := fallback(conn, key)
+		if perms != nil {
+			delete(perms.Extensions, "cert-key-id")
+			delete(perms.Extensions, "cert-principals")
+		}
+		return perms, err
+	}
+	if ca == nil || len(ca.UserCAs) == 0 {
+		return plain
+	}
+	return func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		cert, ok := key.(*ssh.Certificate)
+		if !ok {
+			return plain(conn, key)
+		}
+		principals := ca.UserPrincipals
+		if len(principals) == 0 {
+			principals = []string{conn.User()}
+		}
+		if err := ca.checkCert(cert, ssh.UserCert, ca.UserCAs, principals); err != nil {
+			return nil, fmt.Errorf("rejected certificate %q: %w", cert.KeyId, err)
+		}
+
+		// source-address stays in CriticalOptions for ssh to enforce
+		perms := &ssh.Permissions{
+			CriticalOptions: map[string]string{},
+			Extensions:      map[string]string{},
+		}
+		for k, v := range cert.CriticalOptions {
+			perms.CriticalOptions[k] = v
+		}
+		for k, v := range cert.Extensions {
+			perms.Extensions[k] = v
+		}
+		// like sshd a certificate forwards ports only if it says so,
+		// PermitForwarding reads this like the authorized_keys option
+		if _, ok := cert.Extensions[CertPermitPortForwarding]; !ok {
+			perms.Extensions[OptionNoPortForwarding] = ""
+		}
+		perms.Extensions["pubkey-fp"] = ssh.FingerprintSHA256(cert.Key)
+		perms.Extensions["pubkey-type"] = cert.Key.Type()
+		perms.Extensions["cert-key-id"] = cert.KeyId
+		perms.Extensions["cert-principals"] = strings.Join(cert.ValidPrincipals, ",")
+		return perms, nil
+	}
+}
+
+// HostKeyCallback accepts host certificates signed by HostCAs that are
+// valid for one of the principals and hands plain keys to fallback
+func (ca *CertAuthority) HostKeyCallback(principals []string, fallback ssh.HostKeyCallback) ssh.HostKeyCallback {
+	if ca == nil || len(ca.HostCAs) == 0 {
+		return fallback
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		cert, ok := key.(*ssh.Certificate)
+		if !ok {
+			return fallback(hostname, remote, key)
+		}
+		if err := ca.checkCert(cert, ssh.HostCert, ca.HostCAs, principals); err != nil {
+			return fmt.Errorf("rejected host certificate %q: %w", cert.KeyId, err)
+		}
+		return nil
+	}
+}
+
+// CheckHostCert checks a host certificate published outside of the ssh
+// handshake, e.g. in zeroconf
+func (ca *CertAuthority) CheckHostCert(cert *ssh.Certificate, principals []string) error {
+	if ca == nil || len(ca.HostCAs) == 0 {
+		return fmt.Errorf("no host certificate authorities")
+	}
+	return ca.checkCert(cert, ssh.HostCert, ca.HostCAs, principals)
+}
+
+// Certificate returns our certificate of certType for key
+func (ca *CertAuthority) Certificate(key ssh.PublicKey, certType uint32) *ssh.Certificate {
+	if ca == nil {
+		return nil
+	}
+	for _, cert := range ca.Certificates {
+		if cert.CertType == certType && bytes.Equal(cert.Key.Marshal(), key.Marshal()) {
+			return cert
+		}
+	}
+	return nil
+}
+
+// CertSigners returns signers presenting our certificates of certType
+// ahead of the plain signers
+func (ca *CertAuthority) CertSigners(signers []ssh.Signer, certType uint32) ([]ssh.Signer, error) {
+	out := make([]ssh.Signer, 0, len(signers))
+	for _, signer := range signers {
+		cert := ca.Certificate(signer.PublicKey(), certType)
+		if cert == nil {
+			continue
+		}
+		certSigner, err := ssh.NewCertSigner(cert, signer)
+		if err != nil {
+			return nil, fmt.Errorf("certificate %q: %w", cert.KeyId, err)
+		}
+		out = append(out, certSigner)
+	}
+	return append(out, signers...), nil
+}
+
+func containsKey(keys []ssh.PublicKey, key ssh.PublicKey) bool {
+	b := key.Marshal()
+	for _, k := range keys {
+		if bytes.Equal(k.Marshal(), b) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadCertificate reads an OpenSSH certificate such as id_ed25519-cert.pub
+func ReadCertificate(path string) (*ssh.Certificate, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read certificate: %w", err)
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse certificate %s: %w", path, err)
+	}
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a certificate", path)
+	}
+	return cert, nil
+}
+
+// ReadCAKeys reads CA public keys in authorized_keys format
+func ReadCAKeys(path string) ([]ssh.PublicKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read CA keys: %w", err)
+	}
+	keys := []ssh.PublicKey{}
+	for len(bytes.TrimSpace(b)) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse CA keys %s: %w", path, err)
+		}
+		keys = append(keys, key)
+		b = rest
+	}
+	return keys, nil
+}
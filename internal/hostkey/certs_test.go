@@ -0,0 +1,85 @@
+package hostkey
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("NewSignerFromKey %v", err)
+	}
+	return signer
+}
+
+func TestUserCertPortForwarding(t *testing.T) {
+	caSigner, user := newTestSigner(t), newTestSigner(t)
+	ca := &CertAuthority{UserCAs: []ssh.PublicKey{caSigner.PublicKey()}}
+	callback := ca.UserCallback(func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+		t.Fatal("certificate passed to fallback")
+		return nil, nil
+	})
+
+	testCases := []struct {
+		desc       string
+		extensions map[string]string
+		allowed    bool
+	}{
+		{desc: "no extensions"},
+		{desc: "other extensions", extensions: map[string]string{"permit-pty": ""}},
+		{desc: "permit-port-forwarding", extensions: map[string]string{CertPermitPortForwarding: ""}, allowed: true},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			cert := &ssh.Certificate{
+				Key:             user.PublicKey(),
+				CertType:        ssh.UserCert,
+				ValidPrincipals: []string{"pubkey-fp"},
+				ValidBefore:     ssh.CertTimeInfinity,
+				Permissions:     ssh.Permissions{Extensions: tC.extensions},
+			}
+			if err := cert.SignCert(rand.Reader, caSigner); err != nil {
+				t.Fatalf("SignCert %v", err)
+			}
+			perms, err := callback(connMetadata{&net.TCPAddr{}}, cert)
+			if err != nil {
+				t.Fatalf("UserCallback %v", err)
+			}
+			if err := PermitOpen(perms, "example.com", 80); (err == nil) != tC.allowed {
+				t.Errorf("PermitOpen err=%v want allowed=%v", err, tC.allowed)
+			}
+			if err := PermitForwarding(perms); (err == nil) != tC.allowed {
+				t.Errorf("PermitForwarding err=%v want allowed=%v", err, tC.allowed)
+			}
+		})
+	}
+}
+
+func TestUserCallbackPlainKeyCertExtensions(t *testing.T) {
+	user := newTestSigner(t)
+	// a plain key line claiming to be a certificate
+	fallback := func(c ssh.ConnMetadata, _ ssh.PublicKey) (*ssh.Permissions, error) {
+		return optionsPermissions([]string{`cert-principals="admin"`, `cert-key-id="admin"`}, c, time.Now())
+	}
+	for _, ca := range []*CertAuthority{nil, {UserCAs: []ssh.PublicKey{newTestSigner(t).PublicKey()}}} {
+		perms, err := ca.UserCallback(fallback)(connMetadata{&net.TCPAddr{}}, user.PublicKey())
+		if err != nil {
+			t.Fatalf("UserCallback %v", err)
+		}
+		for _, k := range []string{"cert-principals", "cert-key-id"} {
+			if v, ok := perms.Extensions[k]; ok {
+				t.Errorf("plain key set %s=%q", k, v)
+			}
+		}
+	}
+}
@@ -8,11 +8,15 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
-func GetHostKeyCallBack(keys []ssh.PublicKey) (
+func GetHostKeyCallBack(keys []ssh.PublicKey, revoked *RevocationList) (
 	func(hostname string, remote net.Addr, key ssh.PublicKey) error,
 	error) {
 
-	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	return revoked.HostKeyCallback(func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		// without a CA a host certificate is only as good as its key
+		if cert, ok := key.(*ssh.Certificate); ok {
+			key = cert.Key
+		}
 		remoteBytes := key.Marshal()
 		ok := false
 		for _, key := range keys {
@@ -24,17 +28,9 @@ func GetHostKeyCallBack(keys []ssh.PublicKey) (
 			return nil
 		}
 		return fmt.Errorf("host key mismatch")
-	}, nil
+	}), nil
 }
 
-func Signers() ([]ssh.Signer, error) {
-	agent, err := LoadAgent()
-	if err != nil {
-		return nil, err
-	}
-	signers, err := agent.Signers()
-	if err != nil {
-		return nil, fmt.Errorf("Failed to get keys: %w", err)
-	}
-	return signers, nil
+func Signers(src KeySource) ([]ssh.Signer, error) {
+	return orAgent(src).Signers()
 }
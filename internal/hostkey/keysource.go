@@ -0,0 +1,146 @@
+package hostkey
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// KeySource provides private keys for host keys and client authentication
+type KeySource interface {
+	Signers() ([]ssh.Signer, error)
+}
+
+// commenter is implemented by sources that know their keys' comments,
+// keyed by the marshaled public key
+type commenter interface {
+	Comments() (map[string]string, error)
+}
+
+func orAgent(src KeySource) KeySource {
+	if src == nil {
+		return AgentSource{}
+	}
+	return src
+}
+
+// AgentSource uses the keys held by the agent at SSH_AUTH_SOCK
+type AgentSource struct{}
+
+func (AgentSource) Signers() ([]ssh.Signer, error) {
+	agent, err := LoadAgent()
+	if err != nil {
+		return nil, err
+	}
+	signers, err := agent.Signers()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get keys: %w", err)
+	}
+	return signers, nil
+}
+
+func (AgentSource) Comments() (map[string]string, error) {
+	keys, err := List()
+	if err != nil {
+		return nil, err
+	}
+	comments := make(map[string]string, len(keys))
+	for _, key := range keys {
+		comments[string(key.Marshal())] = key.Comment
+	}
+	return comments, nil
+}
+
+// FileSource reads PEM or OpenSSH private keys from disk
+type FileSource struct {
+	Paths      []string
+	Passphrase []byte // used for encrypted keys
+}
+
+func (f FileSource) Signers() ([]ssh.Signer, error) {
+	signers := make([]ssh.Signer, 0, len(f.Paths))
+	for _, path := range f.Paths {
+		pemBytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read private key: %w", err)
+		}
+		var signer ssh.Signer
+		if f.Passphrase != nil {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(pemBytes, f.Passphrase)
+		} else {
+			signer, err = ssh.ParsePrivateKey(pemBytes)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse private key %s: %w", path, err)
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+// GeneratedSource loads an ed25519 key from Path, generating and
+// persisting one the first time
+type GeneratedSource struct {
+	Path string
+}
+
+func (g GeneratedSource) Signers() ([]ssh.Signer, error) {
+	pemBytes, err := ioutil.ReadFile(g.Path)
+	if os.IsNotExist(err) {
+		pemBytes, err = g.generate()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load host key: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(pemBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse host key %s: %w", g.Path, err)
+	}
+	return []ssh.Signer{signer}, nil
+}
+
+func (g GeneratedSource) generate() ([]byte, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	if err := os.MkdirAll(filepath.Dir(g.Path), 0700); err != nil {
+		return nil, err
+	}
+	// the key is written in full before it appears at Path, linking
+	// rather than renaming keeps the first key if processes race
+	f, err := ioutil.TempFile(filepath.Dir(g.Path), filepath.Base(g.Path)+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(pemBytes); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	err = os.Link(f.Name(), g.Path)
+	if os.IsExist(err) {
+		// lost a race with another process generating the same key
+		return ioutil.ReadFile(g.Path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pemBytes, nil
+}
@@ -0,0 +1,78 @@
+package hostkey
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestGeneratedSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "weyoun-hostkey")
+	if err != nil {
+		t.Fatalf("TempDir %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ssh", "host_ed25519")
+
+	src := GeneratedSource{Path: path}
+	first, err := src.Signers()
+	if err != nil {
+		t.Fatalf("Signers %v", err)
+	}
+	second, err := src.Signers()
+	if err != nil {
+		t.Fatalf("Signers %v", err)
+	}
+	if len(first) != 1 || len(second) != 1 {
+		t.Fatalf("want one signer: %d %d", len(first), len(second))
+	}
+	if !bytes.Equal(first[0].PublicKey().Marshal(), second[0].PublicKey().Marshal()) {
+		t.Fatal("generated key was not persisted")
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("bad key file %v %v", fi, err)
+	}
+
+	fromFile, err := FileSource{Paths: []string{path}}.Signers()
+	if err != nil {
+		t.Fatalf("FileSource.Signers %v", err)
+	}
+	if !bytes.Equal(first[0].PublicKey().Marshal(), fromFile[0].PublicKey().Marshal()) {
+		t.Fatal("FileSource loaded a different key")
+	}
+}
+
+func TestGeneratedSourceRace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "host_ed25519")
+
+	const n = 16
+	keys := make(chan []byte, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			signers, err := GeneratedSource{Path: path}.Signers()
+			if err != nil {
+				t.Errorf("Signers %v", err)
+				return
+			}
+			keys <- signers[0].PublicKey().Marshal()
+		}()
+	}
+	wg.Wait()
+	close(keys)
+
+	first := <-keys
+	for key := range keys {
+		if !bytes.Equal(first, key) {
+			t.Fatal("racing generators ended up with different keys")
+		}
+	}
+	if matches, _ := filepath.Glob(path + ".tmp*"); len(matches) > 0 {
+		t.Errorf("temporary files left behind: %v", matches)
+	}
+}
@@ -0,0 +1,149 @@
+package hostkey
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// optionPrefix keeps authorized_keys options apart from the extensions
+// set by the callbacks, a key line can't pose as a certificate
+const optionPrefix = "authorized-keys:"
+
+// authorized_keys options recorded in ssh.Permissions.Extensions
+const (
+	OptionFrom             = optionPrefix + "from"
+	OptionExpiryTime       = optionPrefix + "expiry-time"
+	OptionPermitOpen       = optionPrefix + "permitopen"
+	OptionNoPortForwarding = optionPrefix + "no-port-forwarding"
+	OptionPortForwarding   = optionPrefix + "port-forwarding"
+	OptionRestrict         = optionPrefix + "restrict"
+)
+
+// optionsPermissions enforces from= and expiry-time= for the connection
+// and records every option as an extension under optionPrefix, repeated
+// options such as permitopen are joined with commas
+func optionsPermissions(options []string, c ssh.ConnMetadata, now time.Time) (*ssh.Permissions, error) {
+	extensions := map[string]string{}
+	for _, opt := range options {
+		name, value := opt, ""
+		if i := strings.Index(opt, "="); i >= 0 {
+			name, value = opt[:i], strings.Trim(opt[i+1:], `"`)
+		}
+		name = optionPrefix + strings.ToLower(name)
+
+		switch name {
+		case OptionFrom:
+			if !matchFrom(value, c.RemoteAddr()) {
+				return nil, fmt.Errorf("%v not permitted by from=%q", c.RemoteAddr(), value)
+			}
+		case OptionExpiryTime:
+			expiry, err := parseExpiryTime(value)
+			if err != nil {
+				return nil, err
+			}
+			if !now.Before(expiry) {
+				return nil, fmt.Errorf("key expired at %v", expiry)
+			}
+		}
+
+		if prev, ok := extensions[name]; ok && prev != "" {
+			value = prev + "," + value
+		}
+		extensions[name] = value
+	}
+	return &ssh.Permissions{Extensions: extensions}, nil
+}
+
+// matchFrom matches the remote address against an OpenSSH pattern-list
+// of addresses, wildcards and CIDRs. Host name patterns never match as
+// the address isn't reverse resolved.
+func matchFrom(patterns string, remote net.Addr) bool {
+	ip := remoteIP(remote)
+	if ip == nil {
+		return false
+	}
+	matched := false
+	for _, pattern := range strings.Split(patterns, ",") {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+		ok := false
+		if _, ipNet, err := net.ParseCIDR(pattern); err == nil {
+			ok = ipNet.Contains(ip)
+		} else {
+			ok, _ = path.Match(pattern, ip.String())
+		}
+		if ok && negated {
+			return false
+		}
+		matched = matched || ok
+	}
+	return matched
+}
+
+func remoteIP(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// parseExpiryTime parses YYYYMMDD[HHMM[SS]] in local time, or UTC with a Z suffix
+func parseExpiryTime(value string) (time.Time, error) {
+	loc := time.Local
+	if strings.HasSuffix(value, "Z") {
+		value, loc = strings.TrimSuffix(value, "Z"), time.UTC
+	}
+	for _, layout := range []string{"20060102", "200601021504", "20060102150405"} {
+		if len(value) == len(layout) {
+			return time.ParseInLocation(layout, value, loc)
+		}
+	}
+	return time.Time{}, fmt.Errorf("bad expiry-time %q", value)
+}
+
+// PermitForwarding checks authorized_keys options allow port forwarding,
+// local or remote
+func PermitForwarding(perms *ssh.Permissions) error {
+	if perms == nil {
+		return nil
+	}
+	_, restricted := perms.Extensions[OptionRestrict]
+	_, enabled := perms.Extensions[OptionPortForwarding]
+	_, disabled := perms.Extensions[OptionNoPortForwarding]
+	if disabled || (restricted && !enabled) {
+		return fmt.Errorf("port forwarding disabled for this key")
+	}
+	return nil
+}
+
+// PermitOpen checks authorized_keys options allow forwarding to host:port
+func PermitOpen(perms *ssh.Permissions, host string, port uint32) error {
+	if err := PermitForwarding(perms); err != nil || perms == nil {
+		return err
+	}
+	permitOpen, ok := perms.Extensions[OptionPermitOpen]
+	if !ok {
+		return nil
+	}
+	for _, allowed := range strings.Split(permitOpen, ",") {
+		allowedHost, allowedPort, err := net.SplitHostPort(allowed)
+		if err != nil {
+			continue
+		}
+		if (allowedHost == "*" || allowedHost == host) &&
+			(allowedPort == "*" || allowedPort == strconv.FormatUint(uint64(port), 10)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s not permitted by permitopen", net.JoinHostPort(host, strconv.FormatUint(uint64(port), 10)))
+}
@@ -0,0 +1,81 @@
+package hostkey
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type connMetadata struct {
+	remote net.Addr
+}
+
+func (c connMetadata) User() string          { return "pubkey-fp" }
+func (c connMetadata) SessionID() []byte     { return nil }
+func (c connMetadata) ClientVersion() []byte { return nil }
+func (c connMetadata) ServerVersion() []byte { return nil }
+func (c connMetadata) RemoteAddr() net.Addr  { return c.remote }
+func (c connMetadata) LocalAddr() net.Addr   { return c.remote }
+
+func TestOptionsPermissions(t *testing.T) {
+	conn := connMetadata{&net.TCPAddr{IP: net.ParseIP("192.168.1.20"), Port: 5555}}
+	now := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		desc    string
+		options []string
+		wantErr bool
+	}{
+		{desc: "no options"},
+		{desc: "from cidr", options: []string{`from="192.168.1.0/24"`}},
+		{desc: "from wildcard", options: []string{`from="10.*,192.168.1.*"`}},
+		{desc: "from mismatch", options: []string{`from="10.0.0.0/8"`}, wantErr: true},
+		{desc: "from negated", options: []string{`from="!192.168.1.20,192.168.1.*"`}, wantErr: true},
+		{desc: "not expired", options: []string{`expiry-time="20211231Z"`}},
+		{desc: "expired", options: []string{`expiry-time="202105312359Z"`}, wantErr: true},
+		{desc: "bad expiry", options: []string{`expiry-time="tomorrow"`}, wantErr: true},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			_, err := optionsPermissions(tC.options, conn, now)
+			if (err != nil) != tC.wantErr {
+				t.Fatalf("optionsPermissions err=%v wantErr=%v", err, tC.wantErr)
+			}
+		})
+	}
+}
+
+func TestPermitOpen(t *testing.T) {
+	perms := func(options ...string) *ssh.Permissions {
+		p, err := optionsPermissions(options, connMetadata{&net.TCPAddr{}}, time.Now())
+		if err != nil {
+			t.Fatalf("optionsPermissions %v", err)
+		}
+		return p
+	}
+	testCases := []struct {
+		desc    string
+		perms   *ssh.Permissions
+		host    string
+		port    uint32
+		wantErr bool
+	}{
+		{desc: "unrestricted", perms: perms(), host: "example.com", port: 80},
+		{desc: "no-port-forwarding", perms: perms("no-port-forwarding"), host: "example.com", port: 80, wantErr: true},
+		{desc: "restrict", perms: perms("restrict"), host: "example.com", port: 80, wantErr: true},
+		{desc: "restrict with port-forwarding", perms: perms("restrict", "port-forwarding"), host: "example.com", port: 80},
+		{desc: "permitopen match", perms: perms(`permitopen="db:5432"`, `permitopen="example.com:80"`), host: "example.com", port: 80},
+		{desc: "permitopen wildcard port", perms: perms(`permitopen="example.com:*"`), host: "example.com", port: 443},
+		{desc: "permitopen mismatch", perms: perms(`permitopen="db:5432"`), host: "example.com", port: 80, wantErr: true},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			err := PermitOpen(tC.perms, tC.host, tC.port)
+			if (err != nil) != tC.wantErr {
+				t.Fatalf("PermitOpen err=%v wantErr=%v", err, tC.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package hostkey
+
+import (
+	"path"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// KeyPolicy decides which of our own keys are used as host keys, client
+// keys and announced in TXT records, authorized_keys isn't filtered.
+// Deny rules win and an empty allow list allows all.
+type KeyPolicy struct {
+	AllowTypes, DenyTypes               []string // e.g. ssh-ed25519, sk-ssh-ed25519@openssh.com
+	AllowFingerprints, DenyFingerprints []string // SHA256 fingerprints
+	AllowComments, DenyComments         []string // globs, e.g. cardno:* for gpg-agent smartcard keys
+}
+
+// Allowed reports whether key with the given comment passes the policy,
+// a nil policy allows everything
+func (p *KeyPolicy) Allowed(key ssh.PublicKey, comment string) bool {
+	if p == nil {
+		return true
+	}
+	keyType, fp := key.Type(), ssh.FingerprintSHA256(key)
+	if contains(p.DenyTypes, keyType) || contains(p.DenyFingerprints, fp) ||
+		matchesGlob(p.DenyComments, comment) {
+		return false
+	}
+	if len(p.AllowTypes) > 0 && !contains(p.AllowTypes, keyType) {
+		return false
+	}
+	if len(p.AllowFingerprints) > 0 && !contains(p.AllowFingerprints, fp) {
+		return false
+	}
+	if len(p.AllowComments) > 0 && !matchesGlob(p.AllowComments, comment) {
+		return false
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesGlob(patterns []string, s string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, s); ok {
+			return true
+		}
+	}
+	return false
+}
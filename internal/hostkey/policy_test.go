@@ -0,0 +1,46 @@
+package hostkey
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestKeyPolicy(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey %v", err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("NewPublicKey %v", err)
+	}
+	fp := ssh.FingerprintSHA256(key)
+
+	testCases := []struct {
+		desc    string
+		policy  *KeyPolicy
+		comment string
+		allowed bool
+	}{
+		{desc: "nil policy", allowed: true},
+		{desc: "empty policy", policy: &KeyPolicy{}, allowed: true},
+		{desc: "deny rsa", policy: &KeyPolicy{DenyTypes: []string{"ssh-rsa"}}, allowed: true},
+		{desc: "deny type", policy: &KeyPolicy{DenyTypes: []string{"ssh-ed25519"}}},
+		{desc: "allow sk only", policy: &KeyPolicy{AllowTypes: []string{"sk-ssh-ed25519@openssh.com"}}},
+		{desc: "deny fingerprint", policy: &KeyPolicy{DenyFingerprints: []string{fp}}},
+		{desc: "allow fingerprint", policy: &KeyPolicy{AllowFingerprints: []string{fp}}, allowed: true},
+		{desc: "deny comment", policy: &KeyPolicy{DenyComments: []string{"cardno:*"}}, comment: "cardno:000612345678"},
+		{desc: "allow comment", policy: &KeyPolicy{AllowComments: []string{"*@laptop"}}, comment: "me@laptop", allowed: true},
+		{desc: "deny wins", policy: &KeyPolicy{AllowFingerprints: []string{fp}, DenyTypes: []string{"ssh-ed25519"}}},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			if got := tC.policy.Allowed(key, tC.comment); got != tC.allowed {
+				t.Fatalf("Allowed() = %v want %v", got, tC.allowed)
+			}
+		})
+	}
+}
@@ -1,14 +1,16 @@
 package hostkey
 
 import (
-	"fmt"
-
 	"github.com/rs/zerolog/log"
 	"golang.org/x/crypto/ssh"
 )
 
-func GetPublicKeysCallback() (ssh.AuthMethod, error) {
-	signers, err := getSigners()
+func GetPublicKeysCallback(src KeySource, policy *KeyPolicy, ca *CertAuthority) (ssh.AuthMethod, error) {
+	signers, err := AllowedSigners(src, policy)
+	if err != nil {
+		return nil, err
+	}
+	signers, err = ca.CertSigners(signers, ssh.UserCert)
 	if err != nil {
 		return nil, err
 	}
@@ -20,31 +22,32 @@ func GetPublicKeysCallback() (ssh.AuthMethod, error) {
 	return ssh.PublicKeysCallback(func() ([]ssh.Signer, error) { return signers, nil }), nil
 }
 
-func getSigners() ([]ssh.Signer, error) {
-	agent, err := LoadAgent()
+// AllowedSigners returns the signers of src that pass policy
+func AllowedSigners(src KeySource, policy *KeyPolicy) ([]ssh.Signer, error) {
+	src = orAgent(src)
+	signers, err := src.Signers()
 	if err != nil {
 		return nil, err
 	}
-	signers, err := agent.Signers()
-	if err != nil {
-		return nil, fmt.Errorf("Failed to get keys: %w", err)
+	comments := map[string]string{}
+	if c, ok := src.(commenter); ok && policy != nil {
+		if comments, err = c.Comments(); err != nil {
+			return nil, err
+		}
 	}
 
 	newSigners := make([]ssh.Signer, 0, len(signers))
 	for _, signer := range signers {
-		// RSA keys are blacklisted because I can't figure out how to
-		// disallow YubiKey keys from my gpg/ssh-agent
-		if signer.PublicKey().Type() == "ssh-rsa" {
-			continue
+		pk := signer.PublicKey()
+		if policy.Allowed(pk, comments[string(pk.Marshal())]) {
+			newSigners = append(newSigners, signer)
 		}
-		newSigners = append(newSigners, signer)
 	}
-
 	return newSigners, nil
 }
 
-func PublicKeys() ([]ssh.PublicKey, error) {
-	signers, err := getSigners()
+func PublicKeys(src KeySource, policy *KeyPolicy) ([]ssh.PublicKey, error) {
+	signers, err := AllowedSigners(src, policy)
 	if err != nil {
 		return nil, err
 	}
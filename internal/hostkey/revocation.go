@@ -0,0 +1,378 @@
+package hostkey
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// krlMagic starts an OpenSSH KRL, see PROTOCOL.krl
+const krlMagic = "SSHKRL\n\x00"
+
+const (
+	krlSectionCertificates      = 1
+	krlSectionExplicitKey       = 2
+	krlSectionFingerprintSHA1   = 3
+	krlSectionSignature         = 4
+	krlSectionFingerprintSHA256 = 5
+
+	krlSectionCertSerialList   = 0x20
+	krlSectionCertSerialRange  = 0x21
+	krlSectionCertSerialBitmap = 0x22
+	krlSectionCertKeyID        = 0x23
+)
+
+// RevocationList holds revoked keys and certificates loaded from an
+// OpenSSH KRL or a file of fingerprints and public keys
+type RevocationList struct {
+	keys   map[string]struct{} // marshaled public keys
+	sha1   map[string]struct{}
+	sha256 map[string]struct{}
+	certs  []revokedCerts
+}
+
+// revokedCerts are the certificates revoked for one CA, a nil ca
+// matches certificates from any CA
+type revokedCerts struct {
+	ca      ssh.PublicKey
+	serials []serialRange
+	bitmaps []serialBitmap
+	keyIDs  map[string]struct{}
+}
+
+type serialRange struct{ min, max uint64 }
+
+type serialBitmap struct {
+	offset uint64
+	bits   *big.Int
+}
+
+func newRevocationList() *RevocationList {
+	return &RevocationList{
+		keys:   map[string]struct{}{},
+		sha1:   map[string]struct{}{},
+		sha256: map[string]struct{}{},
+	}
+}
+
+// ReadRevocationList reads an OpenSSH KRL as written by ssh-keygen -k
+// or a text file with a SHA256 fingerprint or public key per line
+func ReadRevocationList(path string) (*RevocationList, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read revocation list: %w", err)
+	}
+	r, err := ParseRevocationList(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return r, nil
+}
+
+func ParseRevocationList(b []byte) (*RevocationList, error) {
+	if bytes.HasPrefix(b, []byte(krlMagic)) {
+		return parseKRL(b)
+	}
+	return parseRevokedText(b)
+}
+
+func parseRevokedText(b []byte) (*RevocationList, error) {
+	r := newRevocationList()
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "SHA256:") {
+			hash, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(line, "SHA256:"))
+			if err != nil || len(hash) != sha256.Size {
+				return nil, fmt.Errorf("line %d: bad fingerprint %q", n, line)
+			}
+			r.sha256[string(hash)] = struct{}{}
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		r.keys[string(key.Marshal())] = struct{}{}
+	}
+	return r, scanner.Err()
+}
+
+// krlReader reads the wire encoding used by KRLs
+type krlReader struct {
+	b   []byte
+	err error
+}
+
+func (k *krlReader) fail() {
+	if k.err == nil {
+		k.err = fmt.Errorf("truncated revocation list")
+	}
+	k.b = nil
+}
+
+func (k *krlReader) byte() byte {
+	if len(k.b) < 1 {
+		k.fail()
+		return 0
+	}
+	v := k.b[0]
+	k.b = k.b[1:]
+	return v
+}
+
+func (k *krlReader) uint32() uint32 {
+	if len(k.b) < 4 {
+		k.fail()
+		return 0
+	}
+	v := binary.BigEndian.Uint32(k.b)
+	k.b = k.b[4:]
+	return v
+}
+
+func (k *krlReader) uint64() uint64 {
+	if len(k.b) < 8 {
+		k.fail()
+		return 0
+	}
+	v := binary.BigEndian.Uint64(k.b)
+	k.b = k.b[8:]
+	return v
+}
+
+func (k *krlReader) string() []byte {
+	n := k.uint32()
+	if uint64(len(k.b)) < uint64(n) {
+		k.fail()
+		return nil
+	}
+	v := k.b[:n]
+	k.b = k.b[n:]
+	return v
+}
+
+func parseKRL(b []byte) (*RevocationList, error) {
+	r := newRevocationList()
+	k := &krlReader{b: b[len(krlMagic):]}
+	if version := k.uint32(); k.err == nil && version != 1 {
+		return nil, fmt.Errorf("unsupported KRL format version %d", version)
+	}
+	k.uint64() // krl_version
+	k.uint64() // generated_date
+	k.uint64() // flags
+	k.string() // reserved
+	k.string() // comment
+
+	for k.err == nil && len(k.b) > 0 {
+		sectionType := k.byte()
+		section := &krlReader{b: k.string()}
+		if k.err != nil {
+			break
+		}
+		switch sectionType {
+		case krlSectionCertificates:
+			certs, err := parseKRLCerts(section)
+			if err != nil {
+				return nil, err
+			}
+			r.certs = append(r.certs, certs)
+		case krlSectionExplicitKey:
+			for section.err == nil && len(section.b) > 0 {
+				r.keys[string(section.string())] = struct{}{}
+			}
+		case krlSectionFingerprintSHA1:
+			for section.err == nil && len(section.b) > 0 {
+				r.sha1[string(section.string())] = struct{}{}
+			}
+		case krlSectionFingerprintSHA256:
+			for section.err == nil && len(section.b) > 0 {
+				r.sha256[string(section.string())] = struct{}{}
+			}
+		case krlSectionSignature:
+			// signatures are optional and only ever trailing, the file
+			// is trusted like authorized_keys so they aren't checked
+			return r, nil
+		default:
+			return nil, fmt.Errorf("unknown KRL section %d", sectionType)
+		}
+		if section.err != nil {
+			return nil, section.err
+		}
+	}
+	return r, k.err
+}
+
+func parseKRLCerts(k *krlReader) (revokedCerts, error) {
+	certs := revokedCerts{keyIDs: map[string]struct{}{}}
+	if caBytes := k.string(); len(caBytes) > 0 {
+		ca, err := ssh.ParsePublicKey(caBytes)
+		if err != nil {
+			return certs, fmt.Errorf("bad KRL CA key: %w", err)
+		}
+		certs.ca = ca
+	}
+	k.string() // reserved
+
+	for k.err == nil && len(k.b) > 0 {
+		sectionType := k.byte()
+		section := &krlReader{b: k.string()}
+		switch sectionType {
+		case krlSectionCertSerialList:
+			for section.err == nil && len(section.b) > 0 {
+				serial := section.uint64()
+				certs.serials = append(certs.serials, serialRange{serial, serial})
+			}
+		case krlSectionCertSerialRange:
+			min, max := section.uint64(), section.uint64()
+			certs.serials = append(certs.serials, serialRange{min, max})
+		case krlSectionCertSerialBitmap:
+			offset := section.uint64()
+			bits := new(big.Int).SetBytes(section.string())
+			certs.bitmaps = append(certs.bitmaps, serialBitmap{offset, bits})
+		case krlSectionCertKeyID:
+			for section.err == nil && len(section.b) > 0 {
+				certs.keyIDs[string(section.string())] = struct{}{}
+			}
+		default:
+			return certs, fmt.Errorf("unknown KRL certificate section %d", sectionType)
+		}
+		if section.err != nil {
+			return certs, section.err
+		}
+	}
+	return certs, k.err
+}
+
+func (c *revokedCerts) revoked(cert *ssh.Certificate) bool {
+	if c.ca != nil && !bytes.Equal(c.ca.Marshal(), cert.SignatureKey.Marshal()) {
+		return false
+	}
+	if _, ok := c.keyIDs[cert.KeyId]; ok {
+		return true
+	}
+	// serial 0 means the CA didn't number its certificates
+	if cert.Serial == 0 {
+		return false
+	}
+	for _, r := range c.serials {
+		if cert.Serial >= r.min && cert.Serial <= r.max {
+			return true
+		}
+	}
+	for _, b := range c.bitmaps {
+		if cert.Serial >= b.offset && cert.Serial-b.offset < uint64(b.bits.BitLen()) &&
+			b.bits.Bit(int(cert.Serial-b.offset)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *RevocationList) keyRevoked(key ssh.PublicKey) bool {
+	blob := key.Marshal()
+	if _, ok := r.keys[string(blob)]; ok {
+		return true
+	}
+	sha1Sum := sha1.Sum(blob)
+	if _, ok := r.sha1[string(sha1Sum[:])]; ok {
+		return true
+	}
+	sha256Sum := sha256.Sum256(blob)
+	_, ok := r.sha256[string(sha256Sum[:])]
+	return ok
+}
+
+// Revoked reports whether key is revoked, a certificate is revoked
+// along with its key and the CA that signed it
+func (r *RevocationList) Revoked(key ssh.PublicKey) bool {
+	if r == nil {
+		return false
+	}
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return r.keyRevoked(key)
+	}
+	if r.keyRevoked(cert.Key) || r.keyRevoked(cert.SignatureKey) {
+		return true
+	}
+	for i := range r.certs {
+		if r.certs[i].revoked(cert) {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter returns the keys that aren't revoked
+func (r *RevocationList) Filter(keys []ssh.PublicKey) []ssh.PublicKey {
+	if r == nil {
+		return keys
+	}
+	out := make([]ssh.PublicKey, 0, len(keys))
+	for _, key := range keys {
+		if !r.Revoked(key) {
+			out = append(out, key)
+		}
+	}
+	return out
+}
+
+// Fingerprints returns the SHA256 fingerprints of revoked keys, SHA1
+// hashes can't be turned into these
+func (r *RevocationList) Fingerprints() []string {
+	if r == nil {
+		return nil
+	}
+	fps := make([]string, 0, len(r.keys)+len(r.sha256))
+	for blob := range r.keys {
+		sum := sha256.Sum256([]byte(blob))
+		fps = append(fps, "SHA256:"+base64.RawStdEncoding.EncodeToString(sum[:]))
+	}
+	for sum := range r.sha256 {
+		fps = append(fps, "SHA256:"+base64.RawStdEncoding.EncodeToString([]byte(sum)))
+	}
+	return fps
+}
+
+// UserCallback rejects revoked keys and certificates before next sees them
+func (r *RevocationList) UserCallback(
+	next func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error),
+) func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	if r == nil {
+		return next
+	}
+	return func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		if r.Revoked(key) {
+			return nil, fmt.Errorf("revoked key for %q, fp=%+v", conn.User(), ssh.FingerprintSHA256(key))
+		}
+		return next(conn, key)
+	}
+}
+
+// HostKeyCallback rejects revoked host keys and certificates before
+// next sees them
+func (r *RevocationList) HostKeyCallback(next ssh.HostKeyCallback) ssh.HostKeyCallback {
+	if r == nil {
+		return next
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if r.Revoked(key) {
+			return fmt.Errorf("revoked host key %s", ssh.FingerprintSHA256(key))
+		}
+		return next(hostname, remote, key)
+	}
+}
@@ -0,0 +1,174 @@
+package hostkey
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestKey(t *testing.T) (ssh.PublicKey, ssh.Signer) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("NewSignerFromKey %v", err)
+	}
+	return signer.PublicKey(), signer
+}
+
+// krlWriter builds KRLs the way ssh-keygen -k lays them out
+type krlWriter []byte
+
+func (w *krlWriter) byte(b byte) { *w = append(*w, b) }
+
+func (w *krlWriter) uint32(v uint32) {
+	*w = append(*w, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32((*w)[len(*w)-4:], v)
+}
+
+func (w *krlWriter) uint64(v uint64) {
+	*w = append(*w, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64((*w)[len(*w)-8:], v)
+}
+
+func (w *krlWriter) string(b []byte) {
+	w.uint32(uint32(len(b)))
+	*w = append(*w, b...)
+}
+
+func (w *krlWriter) section(sectionType byte, data krlWriter) {
+	w.byte(sectionType)
+	w.string(data)
+}
+
+func TestKRL(t *testing.T) {
+	explicit, _ := newTestKey(t)
+	hashed, _ := newTestKey(t)
+	other, _ := newTestKey(t)
+	ca, caSigner := newTestKey(t)
+	_, otherCASigner := newTestKey(t)
+
+	cert := func(serial uint64, keyID string, signer ssh.Signer) *ssh.Certificate {
+		c := &ssh.Certificate{
+			Key:         other,
+			Serial:      serial,
+			CertType:    ssh.UserCert,
+			KeyId:       keyID,
+			ValidBefore: ssh.CertTimeInfinity,
+		}
+		if err := c.SignCert(rand.Reader, signer); err != nil {
+			t.Fatalf("SignCert %v", err)
+		}
+		return c
+	}
+
+	var keys krlWriter
+	keys.string(explicit.Marshal())
+	var hashes krlWriter
+	sum := sha256.Sum256(hashed.Marshal())
+	hashes.string(sum[:])
+
+	var serials, ranges, bitmap, ids krlWriter
+	serials.uint64(7)
+	ranges.uint64(100)
+	ranges.uint64(199)
+	bitmap.uint64(1000)
+	bitmap.string([]byte{0x05}) // 1000 and 1002
+	ids.string([]byte("lost-laptop"))
+	var certs krlWriter
+	certs.string(ca.Marshal())
+	certs.string(nil)
+	certs.section(krlSectionCertSerialList, serials)
+	certs.section(krlSectionCertSerialRange, ranges)
+	certs.section(krlSectionCertSerialBitmap, bitmap)
+	certs.section(krlSectionCertKeyID, ids)
+
+	krl := krlWriter(krlMagic)
+	krl.uint32(1)
+	krl.uint64(1)
+	krl.uint64(0)
+	krl.uint64(0)
+	krl.string(nil)
+	krl.string([]byte("test"))
+	krl.section(krlSectionExplicitKey, keys)
+	krl.section(krlSectionFingerprintSHA256, hashes)
+	krl.section(krlSectionCertificates, certs)
+
+	r, err := ParseRevocationList(krl)
+	if err != nil {
+		t.Fatalf("ParseRevocationList %v", err)
+	}
+
+	testCases := []struct {
+		desc    string
+		key     ssh.PublicKey
+		revoked bool
+	}{
+		{desc: "explicit key", key: explicit, revoked: true},
+		{desc: "sha256 fingerprint", key: hashed, revoked: true},
+		{desc: "other key", key: other},
+		{desc: "serial", key: cert(7, "", caSigner), revoked: true},
+		{desc: "serial range", key: cert(150, "", caSigner), revoked: true},
+		{desc: "serial bitmap", key: cert(1002, "", caSigner), revoked: true},
+		{desc: "serial not in bitmap", key: cert(1001, "", caSigner)},
+		{desc: "key id", key: cert(0, "lost-laptop", caSigner), revoked: true},
+		{desc: "valid certificate", key: cert(8, "laptop", caSigner)},
+		{desc: "other CA", key: cert(7, "lost-laptop", otherCASigner)},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			if got := r.Revoked(tC.key); got != tC.revoked {
+				t.Fatalf("Revoked() = %v want %v", got, tC.revoked)
+			}
+		})
+	}
+
+	if fps := r.Fingerprints(); len(fps) != 2 {
+		t.Fatalf("Fingerprints() = %v", fps)
+	}
+	if _, err := ParseRevocationList(krl[:len(krl)-3]); err == nil {
+		t.Fatal("truncated KRL parsed")
+	}
+}
+
+func TestRevokedText(t *testing.T) {
+	byKey, _ := newTestKey(t)
+	byFingerprint, _ := newTestKey(t)
+	other, _ := newTestKey(t)
+
+	text := "# lost laptop\n" +
+		string(ssh.MarshalAuthorizedKey(byKey)) +
+		ssh.FingerprintSHA256(byFingerprint) + "\n"
+	r, err := ParseRevocationList([]byte(text))
+	if err != nil {
+		t.Fatalf("ParseRevocationList %v", err)
+	}
+	if !r.Revoked(byKey) || !r.Revoked(byFingerprint) || r.Revoked(other) {
+		t.Fatal("unexpected revocations")
+	}
+	if keys := r.Filter([]ssh.PublicKey{byKey, other}); len(keys) != 1 || string(keys[0].Marshal()) != string(other.Marshal()) {
+		t.Fatalf("Filter() = %v", keys)
+	}
+
+	var nilList *RevocationList
+	if nilList.Revoked(byKey) {
+		t.Fatal("nil list revoked a key")
+	}
+
+	cb, err := GetHostKeyCallBack([]ssh.PublicKey{byKey, other}, r)
+	if err != nil {
+		t.Fatalf("GetHostKeyCallBack %v", err)
+	}
+	if err := cb("host", nil, byKey); err == nil {
+		t.Fatal("revoked host key accepted")
+	}
+	if err := cb("host", nil, other); err != nil {
+		t.Fatalf("host key rejected %v", err)
+	}
+}
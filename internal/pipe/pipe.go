@@ -0,0 +1,31 @@
+// Package pipe relays bytes between two connections
+package pipe
+
+import "io"
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Join copies between a and b in both directions until both are done.
+// When one side stops sending the other's write half is closed if it
+// supports CloseWrite, like net.TCPConn and ssh.Channel, so half-closed
+// protocols keep working. The first copy error is returned, the caller
+// closes a and b.
+func Join(a, b io.ReadWriter) error {
+	errs := make(chan error, 2)
+	copyHalf := func(dst, src io.ReadWriter) {
+		_, err := io.Copy(dst, src)
+		if cw, ok := dst.(closeWriter); ok {
+			cw.CloseWrite()
+		}
+		errs <- err
+	}
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	err := <-errs
+	if err2 := <-errs; err == nil {
+		err = err2
+	}
+	return err
+}
@@ -0,0 +1,72 @@
+package pipe
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"jonwillia.ms/weyoun/pkg/pipenet"
+)
+
+// connPair returns both ends of a pipenet connection
+func connPair(ctx context.Context, t *testing.T, network *pipenet.Network) (net.Conn, net.Conn) {
+	l, err := network.Listen(ctx)
+	if err != nil {
+		t.Fatalf("Listen %v", err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+	c, err := network.DialContext(ctx, "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial %v", err)
+	}
+	return c, <-accepted
+}
+
+func TestJoinHalfClose(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	network := pipenet.New()
+	client, a := connPair(ctx, t, network)
+	b, server := connPair(ctx, t, network)
+	defer client.Close()
+	defer server.Close()
+
+	joined := make(chan error, 1)
+	go func() {
+		defer a.Close()
+		defer b.Close()
+		joined <- Join(a, b)
+	}()
+
+	// the server answers only once the client is done sending
+	go func() {
+		req, _ := ioutil.ReadAll(server)
+		server.Write(append([]byte("re: "), req...))
+		server.(interface{ CloseWrite() error }).CloseWrite()
+	}()
+
+	client.Write([]byte("ping"))
+	client.(interface{ CloseWrite() error }).CloseWrite()
+	reply, err := ioutil.ReadAll(client)
+	if err != nil || string(reply) != "re: ping" {
+		t.Fatalf("ReadAll = %q, %v", reply, err)
+	}
+
+	select {
+	case err := <-joined:
+		if err != nil && err != io.EOF {
+			t.Fatalf("Join %v", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("Join didn't return after both sides closed")
+	}
+}
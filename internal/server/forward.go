@@ -0,0 +1,232 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+	"jonwillia.ms/weyoun/internal/hostkey"
+	"jonwillia.ms/weyoun/internal/pipe"
+	"jonwillia.ms/weyoun/pkg/handlers"
+)
+
+// RFC 4254 7.1
+type tcpipForwardMsg struct {
+	BindAddr string
+	BindPort uint32
+}
+
+// RFC 4254 7.2
+type forwardedTCPIPMsg struct {
+	Addr       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// forwards are the tcpip-forward listeners of one connection
+type forwards struct {
+	mu        sync.Mutex
+	listeners map[string]net.Listener
+}
+
+func forwardKey(host string, port uint32) string {
+	return net.JoinHostPort(host, strconv.Itoa(int(port)))
+}
+
+func (f *forwards) closeAll() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for k, l := range f.listeners {
+		l.Close()
+		delete(f.listeners, k)
+	}
+}
+
+func (s *Server) handleGlobalRequests(ctx context.Context, conn *ssh.ServerConn, reqs <-chan *ssh.Request) {
+	f := &forwards{listeners: map[string]net.Listener{}}
+	defer f.closeAll()
+	for req := range reqs {
+		switch req.Type {
+		case "tcpip-forward":
+			s.handleTCPIPForward(ctx, conn, f, req)
+		case "cancel-tcpip-forward":
+			msg := tcpipForwardMsg{}
+			if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			k := forwardKey(msg.BindAddr, msg.BindPort)
+			f.mu.Lock()
+			l, ok := f.listeners[k]
+			delete(f.listeners, k)
+			f.mu.Unlock()
+			if ok {
+				l.Close()
+			}
+			req.Reply(ok, nil)
+		case handlers.CapabilitiesRequest:
+			peer, _ := handlers.PeerInfoFromContext(ctx)
+			caps := s.handlers.Capabilities().Authorized(s.handlers.Policy, peer)
+			// authorized_keys options and certificates may forbid forwarding
+			if hostkey.PermitForwarding(conn.Permissions) != nil {
+				delete(caps.Channels, "direct-tcpip")
+				delete(caps.Channels, "tcpip-forward")
+			}
+			req.Reply(true, caps.Marshal())
+		default:
+			s.handleGlobalRequest(ctx, req)
+		}
+	}
+}
+
+// keepalive is sent by OpenSSH clients with ServerAliveInterval, any
+// reply shows the server is alive
+const keepalive = "keepalive@openssh.com"
+
+// handleGlobalRequest passes req to Handlers.Global, it runs before the
+// next request is read since replies must be in request order
+func (s *Server) handleGlobalRequest(ctx context.Context, req *ssh.Request) {
+	handler, ok := s.handlers.Global[req.Type]
+	if !ok {
+		// Reply is a no-op unless the client wants one
+		req.Reply(req.Type == keepalive, nil)
+		return
+	}
+	peer, _ := handlers.PeerInfoFromContext(ctx)
+	if err := s.handlers.Policy.Authorize(req.Type, peer); err != nil {
+		log.Warn().Err(err).Str("type", req.Type).Msg("global request denied by policy")
+		req.Reply(false, nil)
+		return
+	}
+	ok, reply := handler(ctx, peer, req.Payload)
+	if err := req.Reply(ok, reply); err != nil {
+		log.Error().Err(err).Str("type", req.Type).Msg("failed to reply to global request")
+	}
+}
+
+func (s *Server) handleTCPIPForward(ctx context.Context, conn *ssh.ServerConn, f *forwards, req *ssh.Request) {
+	msg := tcpipForwardMsg{}
+	if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
+		log.Error().Err(err).Msg("malformed tcpip-forward request")
+		req.Reply(false, nil)
+		return
+	}
+	peer, _ := handlers.PeerInfoFromContext(ctx)
+	rf := s.handlers.RemoteForward
+	if rf == nil {
+		req.Reply(false, nil)
+		return
+	}
+	if err := hostkey.PermitForwarding(conn.Permissions); err != nil {
+		log.Warn().Err(err).Msg("tcpip-forward denied by authorized_keys")
+		req.Reply(false, nil)
+		return
+	}
+	if err := s.handlers.Policy.AuthorizeForward(peer, msg.BindAddr, msg.BindPort); err != nil {
+		log.Warn().Err(err).Msg("tcpip-forward denied by policy")
+		req.Reply(false, nil)
+		return
+	}
+	if rf.Allow != nil && !rf.Allow(ctx, msg.BindAddr, msg.BindPort) {
+		log.Warn().Str("addr", forwardKey(msg.BindAddr, msg.BindPort)).Msg("tcpip-forward denied")
+		req.Reply(false, nil)
+		return
+	}
+
+	k := forwardKey(msg.BindAddr, msg.BindPort)
+	f.mu.Lock()
+	_, dup := f.listeners[k]
+	f.mu.Unlock()
+	if dup {
+		log.Warn().Str("addr", k).Msg("tcpip-forward already listening")
+		req.Reply(false, nil)
+		return
+	}
+	l, err := listenForward(ctx, rf, forwardKey(bindHost(rf, msg.BindAddr), msg.BindPort))
+	if err != nil {
+		log.Error().Err(err).Msg("tcpip-forward failed to listen")
+		req.Reply(false, nil)
+		return
+	}
+	port := msg.BindPort
+	if addr, ok := l.Addr().(*net.TCPAddr); ok {
+		port = uint32(addr.Port)
+	}
+	// cancel-tcpip-forward names the port the server bound, which the
+	// client learns from the reply when it asked for port 0
+	k = forwardKey(msg.BindAddr, port)
+	f.mu.Lock()
+	if _, dup := f.listeners[k]; dup {
+		f.mu.Unlock()
+		l.Close()
+		log.Warn().Str("addr", k).Msg("tcpip-forward already listening")
+		req.Reply(false, nil)
+		return
+	}
+	f.listeners[k] = l
+	f.mu.Unlock()
+
+	var reply []byte
+	if msg.BindPort == 0 {
+		reply = ssh.Marshal(&struct{ Port uint32 }{port})
+	}
+	req.Reply(true, reply)
+	log.Info().Str("addr", l.Addr().String()).Str("key", peer.Fingerprint).Msg("forwarding")
+
+	go func() {
+		defer l.Close()
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go forwardConn(conn, c, msg.BindAddr, port)
+		}
+	}()
+}
+
+// bindHost is the address a forward requested on host listens on
+func bindHost(rf *handlers.RemoteForward, host string) string {
+	if rf.GatewayPorts {
+		if host == "*" {
+			return ""
+		}
+		return host
+	}
+	if host == "localhost" {
+		return host
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return host
+	}
+	return "127.0.0.1"
+}
+
+func listenForward(ctx context.Context, rf *handlers.RemoteForward, addr string) (net.Listener, error) {
+	if rf.Listen != nil {
+		return rf.Listen(ctx, addr)
+	}
+	lc := net.ListenConfig{}
+	return lc.Listen(ctx, "tcp", addr)
+}
+
+func forwardConn(conn *ssh.ServerConn, c net.Conn, addr string, port uint32) {
+	defer c.Close()
+	msg := forwardedTCPIPMsg{Addr: addr, Port: port}
+	if origin, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		msg.OriginAddr, msg.OriginPort = origin.IP.String(), uint32(origin.Port)
+	}
+	channel, reqs, err := conn.OpenChannel("forwarded-tcpip", ssh.Marshal(&msg))
+	if err != nil {
+		log.Error().Err(err).Msg("failed to open forwarded-tcpip channel")
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	defer channel.Close()
+
+	pipe.Join(channel, c)
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"jonwillia.ms/weyoun/internal/hostkey"
+	"jonwillia.ms/weyoun/pkg/handlers"
+	"jonwillia.ms/weyoun/pkg/pipenet"
+)
+
+func newSigner(t *testing.T) ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("NewSignerFromKey %v", err)
+	}
+	return signer
+}
+
+// dial starts a Server whose only key is authorized with options and
+// returns a client connected to it
+func dial(ctx context.Context, t *testing.T, h handlers.Handlers, options map[string]string) *ssh.Client {
+	hostKey, userKey := newSigner(t), newSigner(t)
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			extensions := map[string]string{"pubkey-fp": ssh.FingerprintSHA256(key)}
+			for k, v := range options {
+				extensions[k] = v
+			}
+			return &ssh.Permissions{Extensions: extensions}, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	network := pipenet.New()
+	listener, err := network.Listen(ctx)
+	if err != nil {
+		t.Fatalf("Listen %v", err)
+	}
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	s := New(listener.Accept, func() (*ssh.ServerConfig, error) { return config, nil }, h, 1)
+	go s.Start(ctx)
+
+	conn, err := network.DialContext(ctx, "tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial %v", err)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, listener.Addr().String(), &ssh.ClientConfig{
+		User:            "pubkey-fp",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(userKey)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         time.Second,
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn %v", err)
+	}
+	client := ssh.NewClient(c, chans, reqs)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestRemoteForwardOptions(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		options map[string]string
+		allowed bool
+	}{
+		{desc: "unrestricted", allowed: true},
+		{desc: "restrict", options: map[string]string{hostkey.OptionRestrict: ""}},
+		{desc: "no-port-forwarding", options: map[string]string{hostkey.OptionNoPortForwarding: ""}},
+		{desc: "restrict with port-forwarding", options: map[string]string{
+			hostkey.OptionRestrict: "", hostkey.OptionPortForwarding: "",
+		}, allowed: true},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			listened := false
+			network := pipenet.New()
+			client := dial(ctx, t, handlers.Handlers{
+				RemoteForward: &handlers.RemoteForward{
+					Listen: func(ctx context.Context, addr string) (net.Listener, error) {
+						listened = true
+						return network.Listen(ctx)
+					},
+				},
+			}, tC.options)
+
+			l, err := client.Listen("tcp", "127.0.0.1:0")
+			if (err == nil) != tC.allowed {
+				t.Fatalf("Listen err=%v want allowed=%v", err, tC.allowed)
+			}
+			if err == nil {
+				if err := l.Close(); err != nil {
+					t.Errorf("Close %v", err)
+				}
+			}
+			if listened != tC.allowed {
+				t.Errorf("server listened=%v want %v", listened, tC.allowed)
+			}
+		})
+	}
+}
+
+func TestRemoteForwardCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	network := pipenet.New()
+	client := dial(ctx, t, handlers.Handlers{
+		RemoteForward: &handlers.RemoteForward{
+			Listen: func(ctx context.Context, addr string) (net.Listener, error) {
+				return network.Listen(ctx)
+			},
+		},
+	}, nil)
+
+	// each forward answers with its own name
+	forward := func(name string) (net.Listener, int) {
+		l, err := client.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen %v", err)
+		}
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				c.Write([]byte(name))
+				c.Close()
+			}
+		}()
+		return l, l.Addr().(*net.TCPAddr).Port
+	}
+	read := func(port int) (string, error) {
+		c, err := network.DialContext(ctx, "tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+		if err != nil {
+			return "", err
+		}
+		defer c.Close()
+		b, err := ioutil.ReadAll(c)
+		return string(b), err
+	}
+
+	first, firstPort := forward("first")
+	second, secondPort := forward("second")
+	defer second.Close()
+	if firstPort == secondPort {
+		t.Fatalf("both forwards on port %d", firstPort)
+	}
+	for port, want := range map[int]string{firstPort: "first", secondPort: "second"} {
+		if got, err := read(port); err != nil || got != want {
+			t.Errorf("forward on %d = %q, %v want %q", port, got, err, want)
+		}
+	}
+
+	if err := first.Close(); err != nil {
+		t.Fatalf("Close %v", err)
+	}
+	if _, err := read(firstPort); err == nil {
+		t.Error("server still listening after cancel-tcpip-forward")
+	}
+	if got, err := read(secondPort); err != nil || got != "second" {
+		t.Errorf("second forward = %q, %v after cancelling the first", got, err)
+	}
+}
+
+func TestRemoteForwardBindAddress(t *testing.T) {
+	testCases := []struct {
+		desc         string
+		gatewayPorts bool
+		addr, want   string
+	}{
+		{desc: "loopback", addr: "127.0.0.1:0", want: "127.0.0.1:0"},
+		{desc: "ipv6 loopback", addr: "[::1]:0", want: "[::1]:0"},
+		{desc: "all interfaces", addr: "0.0.0.0:0", want: "127.0.0.1:0"},
+		{desc: "lan address", addr: "192.168.1.2:0", want: "127.0.0.1:0"},
+		{desc: "gateway all interfaces", gatewayPorts: true, addr: "0.0.0.0:0", want: "0.0.0.0:0"},
+		{desc: "gateway lan address", gatewayPorts: true, addr: "192.168.1.2:0", want: "192.168.1.2:0"},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			network := pipenet.New()
+			bound := make(chan string, 1)
+			client := dial(ctx, t, handlers.Handlers{
+				RemoteForward: &handlers.RemoteForward{
+					GatewayPorts: tC.gatewayPorts,
+					Listen: func(ctx context.Context, addr string) (net.Listener, error) {
+						bound <- addr
+						return network.Listen(ctx)
+					},
+				},
+			}, nil)
+
+			l, err := client.Listen("tcp", tC.addr)
+			if err != nil {
+				t.Fatalf("Listen %v", err)
+			}
+			defer l.Close()
+			if got := <-bound; got != tC.want {
+				t.Errorf("server listened on %s want %s", got, tC.want)
+			}
+		})
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/rs/zerolog/log"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/sync/semaphore"
+	"jonwillia.ms/weyoun/internal/hostkey"
 	"jonwillia.ms/weyoun/pkg/handlers"
 )
 
@@ -17,11 +18,12 @@ func New(
 	accept func() (net.Conn, error),
 	config func() (*ssh.ServerConfig, error),
 	handlers handlers.Handlers,
+	unauthMultiplier int,
 ) *Server {
 
-	const (
+	if unauthMultiplier <= 0 {
 		unauthMultiplier = 5
-	)
+	}
 	var (
 		maxUnauthWorkers = runtime.GOMAXPROCS(0) * unauthMultiplier
 		sem              = semaphore.NewWeighted(int64(maxUnauthWorkers))
@@ -73,13 +75,14 @@ func (s *Server) Start(ctx context.Context) {
 
 				return
 			}
-			ctx, cancel := context.WithCancel(ctx)
+			peer := handlers.NewPeerInfo(conn)
+			ctx, cancel := context.WithCancel(handlers.WithPeerInfo(ctx, peer))
 			go func() {
 				conn.Wait()
 				cancel()
 			}()
-			u := conn.User()
-			log.Info().Str("user", u).Str("key", conn.Permissions.Extensions["pubkey-fp"]).Str("type", conn.Permissions.Extensions["pubkey-type"]).Msg("logged in")
+			log.Info().Str("user", peer.User).Str("key", peer.Fingerprint).Str("type", peer.KeyType).
+				Str("addr", peer.RemoteAddr.String()).Str("version", peer.ClientVersion).Msg("logged in")
 			go s.handleConn(ctx, conn, chans, reqs)
 		}()
 	}
@@ -89,30 +92,52 @@ func (s *Server) handleConn(ctx context.Context,
 	conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request,
 ) {
 	defer conn.Close()
-	go ssh.DiscardRequests(reqs)
+	go s.handleGlobalRequests(ctx, conn, reqs)
+	peer, _ := handlers.PeerInfoFromContext(ctx)
 	for newChannel := range chans {
-		var cb func(ctx context.Context, channel ssh.Channel, extraData []byte)
+		var cb handlers.ChannelHandler
 		ct := newChannel.ChannelType()
+		if err := s.handlers.Policy.Authorize(ct, peer); err != nil {
+			log.Warn().Err(err).Str("ChannelType", ct).Msg("denied by policy")
+			newChannel.Reject(ssh.Prohibited, err.Error())
+			continue
+		}
 		switch ct {
 		case "session":
 			go s.handleSessionChannel(ctx, newChannel)
 			continue
 		case "direct-tcpip":
 			if s.handlers.OpenDirect != nil {
-				cb = func(ctx context.Context, channel ssh.Channel, extraData []byte) {
-					msg := handlers.ChannelOpenDirectMsg{}
-					err := ssh.Unmarshal(extraData, &msg)
-					if err != nil {
-						log.Error().Err(err).Str("ChannelType", ct).Msg("failed to Unmarshal")
-						return
-					}
+				msg := handlers.ChannelOpenDirectMsg{}
+				err := ssh.Unmarshal(newChannel.ExtraData(), &msg)
+				if err != nil {
+					log.Error().Err(err).Str("ChannelType", ct).Msg("failed to Unmarshal")
+					newChannel.Reject(ssh.ConnectionFailed, "malformed direct-tcpip request")
+					continue
+				}
+				if err := hostkey.PermitOpen(conn.Permissions, msg.Raddr, msg.Rport); err != nil {
+					log.Warn().Err(err).Str("ChannelType", ct).Msg("denied by authorized_keys")
+					newChannel.Reject(ssh.Prohibited, err.Error())
+					continue
+				}
+				if err := s.handlers.Policy.AuthorizeDirect(peer, msg); err != nil {
+					log.Warn().Err(err).Str("ChannelType", ct).Msg("denied by policy")
+					newChannel.Reject(ssh.Prohibited, err.Error())
+					continue
+				}
+				cb = func(ctx context.Context, channel ssh.Channel, reqs <-chan *ssh.Request, extraData []byte) {
+					go ssh.DiscardRequests(reqs)
 					s.handlers.OpenDirect(ctx, channel, msg)
 				}
 			}
 		default:
-			handler, ok := s.handlers.FreeForm[ct]
-			if ok {
+			if handler, ok := s.handlers.Channels[ct]; ok {
 				cb = handler
+			} else if handler, ok := s.handlers.FreeForm[ct]; ok {
+				cb = func(ctx context.Context, channel ssh.Channel, reqs <-chan *ssh.Request, extraData []byte) {
+					go ssh.DiscardRequests(reqs)
+					handler(ctx, channel, extraData)
+				}
 			}
 		}
 		if cb != nil {
@@ -121,30 +146,13 @@ func (s *Server) handleConn(ctx context.Context,
 				log.Error().Err(err).Str("ChannelType", ct).Msg("failed newChannel.Accept")
 				continue
 			}
-			go ssh.DiscardRequests(reqs)
+			extraData := newChannel.ExtraData()
 			go func() {
 				defer channel.Close()
-				cb(ctx, channel, newChannel.ExtraData())
+				cb(ctx, channel, reqs, extraData)
 			}()
 		} else {
 			newChannel.Reject(ssh.UnknownChannelType, fmt.Sprintf("unknown channel type %v", newChannel.ChannelType()))
 		}
 	}
 }
-
-func (s *Server) handleSessionChannel(ctx context.Context, newChannel ssh.NewChannel) {
-	channel, reqs, err := newChannel.Accept()
-	if err != nil {
-		log.Error().Err(err).Msg("handleSessionChannel failed to newChannel.Accept")
-	}
-	defer channel.Close()
-
-	go func(in <-chan *ssh.Request) {
-		for req := range in {
-			req.Reply(req.Type == "shell", nil)
-		}
-	}(reqs)
-
-	channel.Write([]byte("no interactive access sorry\n"))
-
-}
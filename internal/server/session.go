@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+	"jonwillia.ms/weyoun/pkg/handlers"
+)
+
+// RFC 4254 6.4, 6.5 and 6.10
+type envRequestMsg struct {
+	Name  string
+	Value string
+}
+
+type execRequestMsg struct {
+	Command string
+}
+
+type subsystemRequestMsg struct {
+	Name string
+}
+
+type exitStatusMsg struct {
+	Status uint32
+}
+
+// noShell serves shell requests when there is no Shell handler
+func noShell(ctx context.Context, s *handlers.Session) uint32 {
+	s.Write([]byte("no interactive access sorry\n"))
+	return 1
+}
+
+func (s *Server) handleSessionChannel(ctx context.Context, newChannel ssh.NewChannel) {
+	channel, reqs, err := newChannel.Accept()
+	if err != nil {
+		log.Error().Err(err).Msg("handleSessionChannel failed to newChannel.Accept")
+		return
+	}
+	defer channel.Close()
+
+	session := &handlers.Session{Channel: channel}
+	var handler handlers.SessionHandler
+	for req := range reqs {
+		ok := false
+		switch req.Type {
+		case "env":
+			msg := envRequestMsg{}
+			if ok = ssh.Unmarshal(req.Payload, &msg) == nil; ok {
+				session.Env = append(session.Env, msg.Name+"="+msg.Value)
+			}
+		case "pty-req":
+			pty := &handlers.Pty{}
+			if ok = ssh.Unmarshal(req.Payload, pty) == nil; ok {
+				session.Pty = pty
+			}
+		case "exec":
+			msg := execRequestMsg{}
+			if ssh.Unmarshal(req.Payload, &msg) == nil && s.handlers.Exec != nil {
+				session.Command, handler, ok = msg.Command, s.handlers.Exec, true
+			}
+		case "shell":
+			handler, ok = s.handlers.Shell, true
+			if handler == nil {
+				handler = noShell
+			}
+		case "subsystem":
+			msg := subsystemRequestMsg{}
+			if ssh.Unmarshal(req.Payload, &msg) == nil {
+				handler, ok = s.handlers.Subsystem[msg.Name]
+				session.Command = msg.Name
+			}
+		}
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+		if handler != nil {
+			break
+		}
+	}
+	if handler == nil {
+		return
+	}
+
+	// pass on what comes after without letting a handler that doesn't
+	// read block the connection
+	later := make(chan *ssh.Request, 16)
+	session.Requests = later
+	go func() {
+		defer close(later)
+		for req := range reqs {
+			select {
+			case later <- req:
+			default:
+				if req.WantReply {
+					req.Reply(false, nil)
+				}
+			}
+		}
+	}()
+
+	status := handler(ctx, session)
+	channel.CloseWrite()
+	if _, err := channel.SendRequest("exit-status", false, ssh.Marshal(&exitStatusMsg{status})); err != nil {
+		log.Error().Err(err).Msg("failed to send exit-status")
+	}
+}
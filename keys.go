@@ -0,0 +1,45 @@
+package weyoun
+
+import (
+	"golang.org/x/crypto/ssh"
+	"jonwillia.ms/weyoun/internal/hostkey"
+)
+
+// KeySource provides the private keys a Client authenticates with and a
+// Server uses as host keys
+type KeySource = hostkey.KeySource
+
+// AgentKeys uses the ssh-agent at SSH_AUTH_SOCK, the default
+type AgentKeys = hostkey.AgentSource
+
+// KeyFiles reads PEM or OpenSSH private key files
+type KeyFiles = hostkey.FileSource
+
+// GeneratedHostKey generates an ed25519 key at Path on first use,
+// for servers running without an agent
+type GeneratedHostKey = hostkey.GeneratedSource
+
+// KeyPolicy allows or denies keys by type, fingerprint and agent comment
+type KeyPolicy = hostkey.KeyPolicy
+
+// CertAuthority trusts OpenSSH user and host certificates signed by a team CA
+type CertAuthority = hostkey.CertAuthority
+
+// RevocationList rejects keys and certificates revoked by an OpenSSH KRL
+type RevocationList = hostkey.RevocationList
+
+// ReadRevocationList reads an OpenSSH KRL or a file of revoked SHA256
+// fingerprints and public keys
+func ReadRevocationList(path string) (*RevocationList, error) {
+	return hostkey.ReadRevocationList(path)
+}
+
+// ReadCertificate reads an OpenSSH certificate such as id_ed25519-cert.pub
+func ReadCertificate(path string) (*ssh.Certificate, error) {
+	return hostkey.ReadCertificate(path)
+}
+
+// ReadCAKeys reads CA public keys in authorized_keys format
+func ReadCAKeys(path string) ([]ssh.PublicKey, error) {
+	return hostkey.ReadCAKeys(path)
+}
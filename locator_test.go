@@ -2,8 +2,9 @@ package weyoun
 
 import (
 	"context"
-	"fmt"
 	"net"
+	"os"
+	"strconv"
 	"testing"
 	"time"
 
@@ -15,8 +16,15 @@ import (
 
 const timeout = 2 * time.Second
 
+// skipWithoutMulticast skips tests that need real mDNS on the LAN
+func skipWithoutMulticast(t *testing.T) {
+	if os.Getenv("WEYOUN_MDNS_TESTS") == "" {
+		t.Skip("set WEYOUN_MDNS_TESTS to run tests against real multicast")
+	}
+}
+
 func TestLocate(t *testing.T) {
-	// t.SkipNow() //
+	skipWithoutMulticast(t)
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 	c, err := Locate(ctx, "_sleep-proxy._udp", nil, nil)
@@ -28,6 +36,7 @@ func TestLocate(t *testing.T) {
 }
 
 func TestRegisterAndLocate(t *testing.T) {
+	skipWithoutMulticast(t)
 	const (
 		svcName = "whatever"
 	)
@@ -105,12 +114,13 @@ func TestRegisterAndLocate(t *testing.T) {
 				t.Fatal("no HostName")
 			}
 
-			addrStr := fmt.Sprintf("%s:%d", svc.HostName, svc.Port)
+			addrStr := net.JoinHostPort(svc.HostName, strconv.Itoa(svc.Port))
 
 			go func() {
 				conn, err := net.Dial("tcp", addrStr)
 				if err != nil {
-					t.Fatalf("Dial %v", err)
+					t.Errorf("Dial %v", err)
+					return
 				}
 				defer conn.Close()
 			}()
@@ -119,7 +129,8 @@ func TestRegisterAndLocate(t *testing.T) {
 			go func() {
 				conn, err := listener.Accept()
 				if err != nil {
-					t.Fatalf("Accept %v", err)
+					t.Errorf("Accept %v", err)
+					return
 				}
 				defer conn.Close()
 				close(accepted)
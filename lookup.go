@@ -13,6 +13,10 @@ import (
 )
 
 func Locate(ctx context.Context, service string, matchers, negativeMatchers [][]string) (<-chan *zeroconf.ServiceEntry, error) {
+	return locate(ctx, service, "", matchers, negativeMatchers)
+}
+
+func locate(ctx context.Context, service, domain string, matchers, negativeMatchers [][]string) (<-chan *zeroconf.ServiceEntry, error) {
 	resolver, err := zeroconf.NewResolver(nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize resolver: %w", err)
@@ -20,7 +24,7 @@ func Locate(ctx context.Context, service string, matchers, negativeMatchers [][]
 
 	results := make(chan *zeroconf.ServiceEntry)
 	output := make(chan *zeroconf.ServiceEntry)
-	err = resolver.Lookup(ctx, "", service, "", results)
+	err = resolver.Lookup(ctx, "", service, domain, results)
 	if err != nil {
 		return nil, fmt.Errorf("failed to Lookup: %w", err)
 	}
@@ -79,16 +83,20 @@ func match(record []string, matcher []string) bool {
 }
 
 func Register(ctx context.Context, name, service string, tcpAddr *net.TCPAddr, zeroconfKeys []string) error {
+	_, err := register(ctx, name, service, "local.", tcpAddr.Port, zeroconfKeys)
+	return err
+}
 
-	s, err := zeroconf.Register(name, service, "local.", tcpAddr.Port, zeroconfKeys, nil)
+func register(ctx context.Context, name, service, domain string, port int, zeroconfKeys []string) (*zeroconf.Server, error) {
+	s, err := zeroconf.Register(name, service, domain, port, zeroconfKeys, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	go func() {
 		defer s.Shutdown()
 		<-ctx.Done()
 	}()
-	return nil
+	return s, nil
 }
 
 const (
@@ -96,6 +104,9 @@ const (
 	keySsh      = keyPrefix + "key"
 	keyMainPath = keyPrefix + "mainPath"
 	keyUniq     = keyPrefix + "uniq"
+	keyCA       = keyPrefix + "ca"
+	keyProto    = keyPrefix + "proto"
+	keyCaps     = keyPrefix + "caps"
 )
 
 func textRecord(k, v string) string {
@@ -115,6 +126,14 @@ func PublicKeys2TXTRecords(pubKeys []ssh.PublicKey) (result []string) {
 	return
 }
 
+// CAs2TXTRecords announces the user certificate authorities a server trusts
+func CAs2TXTRecords(cas []ssh.PublicKey) (result []string) {
+	for _, ca := range cas {
+		result = append(result, textRecord(keyCA, ssh.FingerprintSHA256(ca)))
+	}
+	return
+}
+
 // HostKeys keys announced in zeroconf as fingerprints
 func HostKeys(svc *zeroconf.ServiceEntry) []string {
 	return parseTextRecord(svc.Text)
@@ -0,0 +1,110 @@
+package weyoun
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// MemoryDiscovery is an in-process Discovery for hermetic tests, every
+// Client and Server sharing one see each other's announcements
+type MemoryDiscovery struct {
+	mu            sync.Mutex
+	announcements map[*memoryAnnouncement]struct{}
+	browsers      map[*memoryBrowser]struct{}
+}
+
+func NewMemoryDiscovery() *MemoryDiscovery {
+	return &MemoryDiscovery{
+		announcements: make(map[*memoryAnnouncement]struct{}),
+		browsers:      make(map[*memoryBrowser]struct{}),
+	}
+}
+
+type memoryAnnouncement struct {
+	m       *MemoryDiscovery
+	service string
+	peer    Peer
+}
+
+type memoryBrowser struct {
+	ctx     context.Context
+	service string
+	output  chan *Peer
+	wg      sync.WaitGroup
+}
+
+func (m *MemoryDiscovery) Announce(ctx context.Context, instance, service string, port int, text []string) (Announcement, error) {
+	a := &memoryAnnouncement{
+		m:       m,
+		service: service,
+		peer: Peer{
+			Instance: instance,
+			HostName: "localhost",
+			Port:     port,
+			AddrIPv4: []net.IP{net.IPv4(127, 0, 0, 1)},
+		},
+	}
+	m.mu.Lock()
+	m.announcements[a] = struct{}{}
+	m.mu.Unlock()
+	a.SetText(text)
+
+	go func() {
+		<-ctx.Done()
+		m.mu.Lock()
+		delete(m.announcements, a)
+		m.mu.Unlock()
+	}()
+	return a, nil
+}
+
+// SetText updates the TXT records and re-announces the peer
+func (a *memoryAnnouncement) SetText(text []string) {
+	a.m.mu.Lock()
+	defer a.m.mu.Unlock()
+	a.peer.Text = append([]string{}, text...)
+	for b := range a.m.browsers {
+		if b.service == a.service {
+			b.send(a.peer)
+		}
+	}
+}
+
+func (m *MemoryDiscovery) Browse(ctx context.Context, service string) (<-chan *Peer, error) {
+	b := &memoryBrowser{
+		ctx:     ctx,
+		service: service,
+		output:  make(chan *Peer),
+	}
+	m.mu.Lock()
+	m.browsers[b] = struct{}{}
+	for a := range m.announcements {
+		if a.service == service {
+			b.send(a.peer)
+		}
+	}
+	m.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		m.mu.Lock()
+		delete(m.browsers, b)
+		m.mu.Unlock()
+		b.wg.Wait()
+		close(b.output)
+	}()
+	return b.output, nil
+}
+
+// send must be called with MemoryDiscovery.mu held
+func (b *memoryBrowser) send(peer Peer) {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		select {
+		case b.output <- &peer:
+		case <-b.ctx.Done():
+		}
+	}()
+}
@@ -0,0 +1,52 @@
+package weyoun
+
+import (
+	"context"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"jonwillia.ms/weyoun/pkg/handlers"
+	"jonwillia.ms/weyoun/pkg/pipenet"
+)
+
+// connectPair serves h on network and runs a Client that finds it
+// through MemoryDiscovery, opts apply to both. It returns once
+// clientHandler does and fails t if that doesn't happen before ctx ends.
+func connectPair(ctx context.Context, t *testing.T, network *pipenet.Network, h handlers.Handlers,
+	clientHandler func(context.Context, *ssh.Client), opts ...Option,
+) {
+	t.Helper()
+	connectPairWith(ctx, t, network, h, clientHandler, opts, opts)
+}
+
+// connectPairWith is connectPair with options for each end, applied
+// after the pipenet and MemoryDiscovery ones so they can replace them.
+// The Server runs first so its port is known when the Client starts.
+func connectPairWith(ctx context.Context, t *testing.T, network *pipenet.Network, h handlers.Handlers,
+	clientHandler func(context.Context, *ssh.Client), serverOpts, clientOpts []Option,
+) {
+	t.Helper()
+	opts := []Option{
+		WithDiscovery(NewMemoryDiscovery()),
+		WithListen(network.Listen),
+		WithDial(network.DialContext),
+	}
+	server := NewServer(t.Name(), h, append(opts[:len(opts):len(opts)], serverOpts...)...)
+	if err := server.Run(ctx); err != nil {
+		t.Fatalf("server.Run %v", err)
+	}
+
+	done := make(chan struct{})
+	c := NewClient(t.Name(), func(ctx context.Context, sshClient *ssh.Client) {
+		defer close(done)
+		clientHandler(ctx, sshClient)
+	}, func(_ context.Context, _ *ssh.Client) {}, nil, append(opts[:len(opts):len(opts)], clientOpts...)...)
+	if err := c.Run(ctx); err != nil {
+		t.Fatalf("client.Run %v", err)
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+		t.Fatal("client handler never ran")
+	}
+}
@@ -0,0 +1,130 @@
+package weyoun
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"jonwillia.ms/weyoun/pkg/handlers"
+)
+
+type PeerState int
+
+const (
+	PeerDiscovered PeerState = iota
+	PeerConnecting
+	PeerConnected
+	PeerDisconnected
+)
+
+func (s PeerState) String() string {
+	switch s {
+	case PeerDiscovered:
+		return "discovered"
+	case PeerConnecting:
+		return "connecting"
+	case PeerConnected:
+		return "connected"
+	case PeerDisconnected:
+		return "disconnected"
+	}
+	return "unknown"
+}
+
+// PeerStatus is a snapshot of a peer known to a Client
+type PeerStatus struct {
+	ID           string // weyoun-uniq
+	Instance     string
+	Addrs        []net.IP
+	Port         int
+	Fingerprints []string
+	Capabilities handlers.Capabilities // as announced, see QueryCapabilities
+	State        PeerState
+	LastSeen     time.Time
+}
+
+type peerEntry struct {
+	PeerStatus
+	peer      *Peer
+	sshClient *ssh.Client
+}
+
+// PeerSet tracks peers by their weyoun-uniq id
+type PeerSet struct {
+	mu    sync.Mutex
+	peers map[string]*peerEntry
+}
+
+func NewPeerSet() *PeerSet {
+	return &PeerSet{
+		peers: make(map[string]*peerEntry),
+	}
+}
+
+// Observe records a sighting of peer and reports whether it should be dialed
+func (p *PeerSet) Observe(peer *Peer, now time.Time) (id string, dial bool) {
+	id = uniq(peer.Text)
+	if id == "" {
+		id = peer.Instance
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	entry, ok := p.peers[id]
+	if !ok {
+		entry = &peerEntry{PeerStatus: PeerStatus{ID: id, State: PeerDiscovered}}
+		p.peers[id] = entry
+	}
+	entry.peer = peer
+	entry.Instance = peer.Instance
+	entry.Addrs = append(append([]net.IP{}, peer.AddrIPv4...), peer.AddrIPv6...)
+	entry.Port = peer.Port
+	entry.Fingerprints = parseTextRecord(peer.Text)
+	entry.Capabilities = TXTRecords2Capabilities(peer.Text)
+	entry.LastSeen = now
+
+	switch entry.State {
+	case PeerConnecting, PeerConnected:
+		return id, false
+	}
+	return id, true
+}
+
+// SetState updates the connection state of a peer
+func (p *PeerSet) SetState(id string, state PeerState, sshClient *ssh.Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	entry, ok := p.peers[id]
+	if !ok {
+		return
+	}
+	entry.State = state
+	entry.sshClient = sshClient
+}
+
+func (p *PeerSet) peer(id string) *Peer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	entry, ok := p.peers[id]
+	if !ok {
+		return nil
+	}
+	return entry.peer
+}
+
+// Snapshot returns the known peers sorted by id
+func (p *PeerSet) Snapshot() []PeerStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := make([]PeerStatus, 0, len(p.peers))
+	for _, entry := range p.peers {
+		status := entry.PeerStatus
+		status.Addrs = append([]net.IP{}, entry.Addrs...)
+		status.Fingerprints = append([]string{}, entry.Fingerprints...)
+		out = append(out, status)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
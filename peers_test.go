@@ -0,0 +1,38 @@
+package weyoun
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPeerSet(t *testing.T) {
+	peers := NewPeerSet()
+	peer := &Peer{
+		Instance: "me@host",
+		Port:     2222,
+		AddrIPv4: []net.IP{net.IPv4(192, 0, 2, 1)},
+		Text:     []string{textRecord(keyUniq, "abc"), textRecord(keySsh, "SHA256:xyz")},
+	}
+
+	id, dial := peers.Observe(peer, time.Now())
+	if id != "abc" || !dial {
+		t.Fatalf("Observe new peer: id=%q dial=%v", id, dial)
+	}
+	peers.SetState(id, PeerConnected, nil)
+	if _, dial := peers.Observe(peer, time.Now()); dial {
+		t.Fatal("Observe connected peer should not dial")
+	}
+	peers.SetState(id, PeerDisconnected, nil)
+	if _, dial := peers.Observe(peer, time.Now()); !dial {
+		t.Fatal("Observe disconnected peer should dial")
+	}
+
+	snapshot := peers.Snapshot()
+	if len(snapshot) != 1 {
+		t.Fatalf("len(snapshot) != 1: %d", len(snapshot))
+	}
+	if p := snapshot[0]; p.Port != 2222 || len(p.Addrs) != 1 || len(p.Fingerprints) != 1 || p.State != PeerDisconnected {
+		t.Fatalf("unexpected snapshot %+v", p)
+	}
+}
@@ -0,0 +1,46 @@
+// Package client speaks the protocol of the weyoun channel type, Client
+// on an *ssh.Client handed to a weyoun clientHandler and Server in the
+// weyoun server's handlers.Handlers:
+//
+//	rpc := client.NewServer()
+//	rpc.Register("hello", func(ctx context.Context, payload []byte) ([]byte, error) {
+//		return []byte("hi"), nil
+//	})
+//	weyoun.NewServer(svc, handlers.Handlers{
+//		Channels: map[string]handlers.ChannelHandler{client.ChannelName(): rpc.ServeChannel},
+//	})
+//
+// and on the other side
+//
+//	c, err := client.NewClient(sshClient)
+//	reply, err := c.Call(ctx, "hello", nil)
+//
+// # Wire format, version 1
+//
+// A weyoun channel opened without extra data carries calls. Every
+// message is a big-endian uint32 length followed by a frame in the SSH
+// wire encoding of RFC 4251:
+//
+//	byte   type
+//	uint32 id
+//	string method
+//	uint64 timeout, nanoseconds left for the call or 0 for none
+//	string payload
+//	string error
+//
+// The client starts with a hello frame whose payload is a uint32, the
+// highest version it speaks. The server answers with a hello carrying the
+// version both will use, or an error frame. The hello is required, a
+// request before it gets a response frame with an error and a cancel is
+// ignored. The client then sends
+// request frames with ids unique among its calls in flight and may send
+// a cancel frame with the id of a call it gave up on. The server answers
+// every request with a response frame of the same id, whose error is
+// set if the call failed.
+//
+// A weyoun channel opened with extra data of a uint32 version and a
+// string method carries one stream. Both sides send data frames and
+// close the channel for writing when done sending. A server handler
+// failing sends an error frame before the channel is closed. Either side
+// closing the channel ends the stream.
+package client
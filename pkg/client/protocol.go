@@ -0,0 +1,91 @@
+package client
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ProtocolVersion is the highest version of the wire format spoken,
+// see the package documentation
+const ProtocolVersion = 1
+
+// Frames on the weyoun channel are a uint32 length followed by an
+// ssh.Marshal encoded frame
+const maxFrameSize = 1 << 24
+
+const (
+	frameRequest  = 1
+	frameResponse = 2
+	frameCancel   = 3
+	frameData     = 4 // a stream message
+	frameError    = 5 // ends a stream with the handler's error
+	frameHello    = 6
+)
+
+type hello struct {
+	Version uint32
+}
+
+// negotiate picks the version to use with a peer speaking up to version
+func negotiate(version uint32) (uint32, error) {
+	if version == 0 {
+		return 0, fmt.Errorf("bad protocol version 0")
+	}
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+	return version, nil
+}
+
+type frame struct {
+	Type    uint8
+	ID      uint32
+	Method  string
+	Timeout uint64 // nanoseconds left when sent, 0 for none
+	Payload []byte
+	Error   string
+}
+
+func writeFrame(w io.Writer, f *frame) error {
+	body := ssh.Marshal(f)
+	if len(body) > maxFrameSize {
+		return fmt.Errorf("frame of %d bytes too large", len(body))
+	}
+	b := make([]byte, 4, 4+len(body))
+	binary.BigEndian.PutUint32(b, uint32(len(body)))
+	_, err := w.Write(append(b, body...))
+	return err
+}
+
+func readFrame(r io.Reader) (*frame, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxFrameSize {
+		return nil, fmt.Errorf("frame of %d bytes too large", n)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	f := &frame{}
+	if err := ssh.Unmarshal(body, f); err != nil {
+		return nil, fmt.Errorf("bad frame: %w", err)
+	}
+	return f, nil
+}
+
+// Error is an error returned by the remote handler
+type Error struct {
+	Method  string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Method, e.Message)
+}
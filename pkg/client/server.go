@@ -0,0 +1,188 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+)
+
+// Handler serves one method, a returned error is passed to the caller
+type Handler func(ctx context.Context, payload []byte) ([]byte, error)
+
+// Server dispatches calls and streams on weyoun channels to registered
+// methods. Serve goes in handlers.Handlers.FreeForm[ChannelName()], or
+// ServeChannel in handlers.Handlers.Channels to also notice a client
+// closing a stream it isn't reading from.
+type Server struct {
+	mu      sync.RWMutex
+	methods map[string]Handler
+	streams map[string]StreamHandler
+}
+
+func NewServer() *Server {
+	return &Server{
+		methods: map[string]Handler{},
+		streams: map[string]StreamHandler{},
+	}
+}
+
+func (s *Server) RegisterStream(method string, handler StreamHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.streams[method] = handler
+}
+
+func (s *Server) Register(method string, handler Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.methods[method] = handler
+}
+
+func (s *Server) handler(method string) (Handler, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	h, ok := s.methods[method]
+	return h, ok
+}
+
+// Serve answers calls on channel until it is closed, calls run
+// concurrently
+func (s *Server) Serve(ctx context.Context, channel ssh.Channel, extra []byte) {
+	s.ServeChannel(ctx, channel, nil, extra)
+}
+
+func (s *Server) ServeChannel(ctx context.Context, channel ssh.Channel, reqs <-chan *ssh.Request, extra []byte) {
+	if len(extra) > 0 {
+		s.serveStream(ctx, channel, reqs, extra)
+		return
+	}
+	if reqs != nil {
+		go ssh.DiscardRequests(reqs)
+	}
+
+	var (
+		wmu     sync.Mutex // serializes frames
+		mu      sync.Mutex // guards cancels, never held while writing
+		cancels = map[uint32]context.CancelFunc{}
+		wg      sync.WaitGroup
+		version uint32 // agreed in the hello, 0 until then
+	)
+	defer wg.Wait()
+	// calls in flight are cancelled when the channel goes away
+	ctx, cancelAll := context.WithCancel(ctx)
+	defer cancelAll()
+
+	for {
+		f, err := readFrame(channel)
+		if err != nil {
+			if err != io.EOF {
+				log.Error().Err(err).Msg("weyoun channel")
+			}
+			return
+		}
+		switch f.Type {
+		case frameHello:
+			reply := &frame{Type: frameHello}
+			h := hello{}
+			negotiated, err := uint32(0), ssh.Unmarshal(f.Payload, &h)
+			if err == nil {
+				negotiated, err = negotiate(h.Version)
+			}
+			if err != nil {
+				reply = &frame{Type: frameError, Error: err.Error()}
+			} else {
+				reply.Payload = ssh.Marshal(&hello{negotiated})
+			}
+			version = negotiated
+			wmu.Lock()
+			err = writeFrame(channel, reply)
+			wmu.Unlock()
+			if err != nil {
+				log.Error().Err(err).Msg("failed to send hello")
+				return
+			}
+		case frameCancel:
+			mu.Lock()
+			if cancel, ok := cancels[f.ID]; ok {
+				cancel()
+			}
+			mu.Unlock()
+		case frameRequest:
+			if version == 0 {
+				wmu.Lock()
+				err := writeFrame(channel, &frame{Type: frameResponse, ID: f.ID, Error: "hello required before calls"})
+				wmu.Unlock()
+				if err != nil {
+					return
+				}
+				continue
+			}
+			var (
+				callCtx context.Context
+				cancel  context.CancelFunc
+			)
+			if f.Timeout > 0 {
+				callCtx, cancel = context.WithTimeout(ctx, time.Duration(f.Timeout))
+			} else {
+				callCtx, cancel = context.WithCancel(ctx)
+			}
+			mu.Lock()
+			cancels[f.ID] = cancel
+			mu.Unlock()
+
+			wg.Add(1)
+			go func(f *frame) {
+				defer wg.Done()
+				reply := &frame{Type: frameResponse, ID: f.ID}
+				if h, ok := s.handler(f.Method); !ok {
+					reply.Error = fmt.Sprintf("unknown method %q", f.Method)
+				} else if payload, err := h(callCtx, f.Payload); err != nil {
+					reply.Error = err.Error()
+				} else {
+					reply.Payload = payload
+				}
+
+				mu.Lock()
+				cancel()
+				delete(cancels, f.ID)
+				mu.Unlock()
+
+				wmu.Lock()
+				defer wmu.Unlock()
+				if err := writeFrame(channel, reply); err != nil {
+					log.Error().Err(err).Str("method", f.Method).Msg("failed to reply")
+				}
+			}(f)
+		}
+	}
+}
+
+func (s *Server) serveStream(ctx context.Context, channel ssh.Channel, reqs <-chan *ssh.Request, extra []byte) {
+	open := streamOpen{}
+	if err := ssh.Unmarshal(extra, &open); err != nil {
+		log.Error().Err(err).Msg("malformed weyoun stream")
+		return
+	}
+	stream := newStream(ctx, open.Method, channel, reqs)
+	defer stream.Close()
+
+	s.mu.RLock()
+	handler, ok := s.streams[open.Method]
+	s.mu.RUnlock()
+	err := fmt.Errorf("unknown stream %q", open.Method)
+	if open.Version == 0 || open.Version > ProtocolVersion {
+		err = fmt.Errorf("unsupported protocol version %d", open.Version)
+	} else if ok {
+		err = handler(stream.Context(), stream)
+	}
+	if err != nil {
+		stream.wmu.Lock()
+		writeFrame(channel, &frame{Type: frameError, Error: err.Error()})
+		stream.wmu.Unlock()
+	}
+}
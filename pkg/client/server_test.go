@@ -0,0 +1,68 @@
+package client
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// pipeChannel is one end of an in-memory ssh.Channel
+type pipeChannel struct {
+	io.Reader
+	io.WriteCloser
+}
+
+func (p pipeChannel) CloseWrite() error { return p.WriteCloser.Close() }
+func (p pipeChannel) SendRequest(string, bool, []byte) (bool, error) {
+	return false, nil
+}
+func (p pipeChannel) Stderr() io.ReadWriter { return nil }
+
+func newPipeChannel() (ssh.Channel, ssh.Channel) {
+	ar, bw := io.Pipe()
+	br, aw := io.Pipe()
+	return pipeChannel{ar, aw}, pipeChannel{br, bw}
+}
+
+func TestServeRequiresHello(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rpc := NewServer()
+	rpc.Register("echo", func(ctx context.Context, payload []byte) ([]byte, error) {
+		return payload, nil
+	})
+	server, c := newPipeChannel()
+	go rpc.Serve(ctx, server, nil)
+	defer c.Close()
+
+	call := func(id uint32) *frame {
+		if err := writeFrame(c, &frame{Type: frameRequest, ID: id, Method: "echo", Payload: []byte("hi")}); err != nil {
+			t.Fatalf("writeFrame %v", err)
+		}
+		f, err := readFrame(c)
+		if err != nil {
+			t.Fatalf("readFrame %v", err)
+		}
+		return f
+	}
+
+	if f := call(1); f.Type != frameResponse || f.ID != 1 || f.Error == "" {
+		t.Fatalf("call before hello = %+v, want an error", f)
+	}
+
+	if err := writeFrame(c, &frame{Type: frameHello, Payload: ssh.Marshal(&hello{ProtocolVersion + 1})}); err != nil {
+		t.Fatalf("writeFrame %v", err)
+	}
+	f, err := readFrame(c)
+	h := hello{}
+	if err != nil || f.Type != frameHello || ssh.Unmarshal(f.Payload, &h) != nil || h.Version != ProtocolVersion {
+		t.Fatalf("hello = %+v, %v", f, err)
+	}
+
+	if f := call(2); f.Error != "" || string(f.Payload) != "hi" {
+		t.Fatalf("call after hello = %+v", f)
+	}
+}
@@ -0,0 +1,245 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	channelName = "weyoun"
+)
+
+// ChannelName is the ssh channel type carrying the weyoun protocol,
+// the key for Server in handlers.Handlers.FreeForm or Channels
+func ChannelName() string { return channelName }
+
+// handshakeTimeout bounds waiting for the server's hello
+const handshakeTimeout = 10 * time.Second
+
+type Client struct {
+	sshClient *ssh.Client
+	channel   ssh.Channel
+	requests  chan *ssh.Request
+
+	version uint32
+	hello   chan *frame
+
+	wmu sync.Mutex // serializes frames, never held while waiting on mu
+
+	mu      sync.Mutex // guards the fields below
+	nextID  uint32
+	pending map[uint32]chan *frame
+	err     error
+}
+
+// NewClient opens a weyoun channel on sshClient and agrees on the
+// protocol version with the server
+func NewClient(sshClient *ssh.Client) (*Client, error) {
+	channel, requests, err := sshClient.OpenChannel(ChannelName(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create channel: %w", err)
+	}
+
+	c := &Client{
+		sshClient: sshClient,
+		channel:   channel,
+		requests:  make(chan *ssh.Request, 16),
+		pending:   map[uint32]chan *frame{},
+		hello:     make(chan *frame, 1),
+	}
+	// once the buffer is full requests are refused, or dropped if they
+	// want no reply, rather than stalling the connection
+	go func(in <-chan *ssh.Request) {
+		defer close(c.requests)
+		for req := range in {
+			select {
+			case c.requests <- req:
+			default:
+				if req.WantReply {
+					req.Reply(false, nil)
+				}
+			}
+		}
+	}(requests)
+	go c.readLoop()
+
+	if err := c.handshake(); err != nil {
+		channel.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Client) handshake() error {
+	c.wmu.Lock()
+	err := writeFrame(c.channel, &frame{Type: frameHello, Payload: ssh.Marshal(&hello{ProtocolVersion})})
+	c.wmu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to send hello: %w", err)
+	}
+
+	timer := time.NewTimer(handshakeTimeout)
+	defer timer.Stop()
+	select {
+	case f, ok := <-c.hello:
+		if !ok {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return c.err
+		}
+		if f.Type == frameError {
+			return fmt.Errorf("server refused protocol version %d: %s", ProtocolVersion, f.Error)
+		}
+		h := hello{}
+		if err := ssh.Unmarshal(f.Payload, &h); err != nil {
+			return fmt.Errorf("bad hello: %w", err)
+		}
+		if h.Version == 0 || h.Version > ProtocolVersion {
+			return fmt.Errorf("server picked unsupported protocol version %d", h.Version)
+		}
+		c.version = h.Version
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("no hello from server")
+	}
+}
+
+// Version is the protocol version agreed with the server
+func (c *Client) Version() uint32 {
+	return c.version
+}
+
+func (c *Client) readLoop() {
+	var err error
+	for {
+		var f *frame
+		if f, err = readFrame(c.channel); err != nil {
+			break
+		}
+		if f.Type == frameHello || (f.Type == frameError && f.ID == 0) {
+			select {
+			case c.hello <- f:
+			default:
+			}
+			continue
+		}
+		if f.Type != frameResponse {
+			continue
+		}
+		c.mu.Lock()
+		if ch, ok := c.pending[f.ID]; ok {
+			delete(c.pending, f.ID)
+			ch <- f
+		}
+		c.mu.Unlock()
+	}
+
+	if err == io.EOF {
+		err = fmt.Errorf("weyoun channel closed")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = err
+	close(c.hello)
+	for id, ch := range c.pending {
+		delete(c.pending, id)
+		close(ch)
+	}
+}
+
+// Call invokes method on the server and waits for its reply, ctx
+// cancels the call on both sides and the time left before its deadline
+// is sent along, so the server needs no synchronised clock
+func (c *Client) Call(ctx context.Context, method string, payload []byte) ([]byte, error) {
+	req := &frame{Type: frameRequest, Method: method, Payload: payload}
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout := time.Until(deadline)
+		if timeout <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+		req.Timeout = uint64(timeout)
+	}
+	reply := make(chan *frame, 1)
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	c.nextID++
+	req.ID = c.nextID
+	c.pending[req.ID] = reply
+	c.mu.Unlock()
+
+	// readLoop keeps delivering replies while a large frame is written
+	c.wmu.Lock()
+	err := writeFrame(c.channel, req)
+	c.wmu.Unlock()
+	if err != nil {
+		c.mu.Lock()
+		delete(c.pending, req.ID)
+		c.mu.Unlock()
+		return nil, fmt.Errorf("failed to send %s: %w", method, err)
+	}
+
+	select {
+	case f, ok := <-reply:
+		if !ok {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return nil, c.err
+		}
+		if f.Error != "" {
+			// the server hit the same deadline, possibly before we did
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+				return nil, context.DeadlineExceeded
+			}
+			return nil, &Error{Method: method, Message: f.Error}
+		}
+		return f.Payload, nil
+	case <-ctx.Done():
+		c.mu.Lock()
+		delete(c.pending, req.ID)
+		c.mu.Unlock()
+		c.wmu.Lock()
+		writeFrame(c.channel, &frame{Type: frameCancel, ID: req.ID})
+		c.wmu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// Stream opens a stream to method on its own channel, it ends when ctx
+// is done, Close is called or the server handler returns
+func (c *Client) Stream(ctx context.Context, method string) (*Stream, error) {
+	channel, reqs, err := c.sshClient.OpenChannel(ChannelName(), ssh.Marshal(&streamOpen{Version: c.version, Method: method}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stream %s: %w", method, err)
+	}
+	return newStream(ctx, method, channel, reqs), nil
+}
+
+// SendRequest sends a channel request to the server's weyoun handler
+func (c *Client) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	return c.channel.SendRequest(name, wantReply, payload)
+}
+
+// Requests are the channel requests sent by the server, closed with the
+// channel. The first 16 are held until read whether or not anyone reads
+// them and any arriving while those are unread are refused, so callers
+// expecting requests must keep draining Requests.
+func (c *Client) Requests() <-chan *ssh.Request {
+	return c.requests
+}
+
+func (c *Client) Close() error {
+	defer c.channel.Close()
+	return nil
+}
@@ -0,0 +1,100 @@
+package client
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// streamOpen is the extra data of a weyoun channel opened for a stream,
+// the channel for calls has none
+type streamOpen struct {
+	Version uint32
+	Method  string
+}
+
+// StreamHandler serves one streaming method, a returned error is passed
+// to the caller's Recv
+type StreamHandler func(ctx context.Context, s *Stream) error
+
+// Stream is a bidirectional message stream on its own weyoun channel so
+// it gets ssh flow control. Either side closing the stream or its
+// context being done ends it for both.
+type Stream struct {
+	method  string
+	channel ssh.Channel
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wmu     sync.Mutex
+}
+
+// newStream ends the stream when ctx is done and, if reqs is given, when
+// the other side closes the channel
+func newStream(ctx context.Context, method string, channel ssh.Channel, reqs <-chan *ssh.Request) *Stream {
+	ctx, cancel := context.WithCancel(ctx)
+	s := &Stream{method: method, channel: channel, ctx: ctx, cancel: cancel}
+	if reqs != nil {
+		go func() {
+			for req := range reqs {
+				if req.WantReply {
+					req.Reply(false, nil)
+				}
+			}
+			// the requests end when the channel is closed
+			cancel()
+		}()
+	}
+	go func() {
+		<-ctx.Done()
+		channel.Close()
+	}()
+	return s
+}
+
+// Context is done once the stream has ended
+func (s *Stream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *Stream) Send(payload []byte) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if err := writeFrame(s.channel, &frame{Type: frameData, Payload: payload}); err != nil {
+		if s.ctx.Err() != nil {
+			return s.ctx.Err()
+		}
+		return err
+	}
+	return nil
+}
+
+// Recv returns the next message, io.EOF once the other side is done
+// sending or the error its handler returned
+func (s *Stream) Recv() ([]byte, error) {
+	f, err := readFrame(s.channel)
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		if s.ctx.Err() != nil {
+			return nil, s.ctx.Err()
+		}
+		return nil, err
+	}
+	if f.Type == frameError {
+		return nil, &Error{Method: s.method, Message: f.Error}
+	}
+	return f.Payload, nil
+}
+
+// CloseSend tells the other side no more messages follow
+func (s *Stream) CloseSend() error {
+	return s.channel.CloseWrite()
+}
+
+func (s *Stream) Close() error {
+	s.cancel()
+	return nil
+}
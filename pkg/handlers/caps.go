@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ProtoVersion is the revision of weyoun's TXT records and global
+// requests, announced as weyoun-proto
+const ProtoVersion = 1
+
+// CapabilitiesRequest is the global request a server answers with the
+// Capabilities the caller may use
+const CapabilitiesRequest = "weyoun-caps@jonwillia.ms"
+
+// Capabilities are the channel types a server serves
+type Capabilities struct {
+	Proto uint32
+	// Channels maps channel types to their version, 0 if unversioned
+	Channels map[string]uint32
+}
+
+// Capabilities lists what h serves, tcpip-forward stands in for
+// RemoteForward and session for Exec, Shell and Subsystem
+func (h Handlers) Capabilities() Capabilities {
+	c := Capabilities{Proto: ProtoVersion, Channels: map[string]uint32{}}
+	if h.OpenDirect != nil {
+		c.Channels["direct-tcpip"] = 0
+	}
+	if h.RemoteForward != nil {
+		c.Channels["tcpip-forward"] = 0
+	}
+	if h.Exec != nil || h.Shell != nil || len(h.Subsystem) > 0 {
+		c.Channels["session"] = 0
+	}
+	for ct := range h.FreeForm {
+		c.Channels[ct] = h.Versions[ct]
+	}
+	for ct := range h.Channels {
+		c.Channels[ct] = h.Versions[ct]
+	}
+	return c
+}
+
+// Has reports whether channelType is served at version or later
+func (c Capabilities) Has(channelType string, version uint32) bool {
+	v, ok := c.Channels[channelType]
+	return ok && v >= version
+}
+
+// Authorized drops the channel types peer may not open under policy,
+// tcpip-forward is checked like AuthorizeForward short of the bind
+// address which isn't known yet
+func (c Capabilities) Authorized(policy *Policy, peer PeerInfo) Capabilities {
+	out := Capabilities{Proto: c.Proto, Channels: map[string]uint32{}}
+	for ct, v := range c.Channels {
+		if policy.Authorize(ct, peer) == nil {
+			out.Channels[ct] = v
+		}
+	}
+	return out
+}
+
+// Strings returns the sorted channel types as type or type/version
+func (c Capabilities) Strings() []string {
+	out := make([]string, 0, len(c.Channels))
+	for ct, v := range c.Channels {
+		if v == 0 {
+			out = append(out, ct)
+		} else {
+			out = append(out, ct+"/"+strconv.FormatUint(uint64(v), 10))
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// AddString adds a channel type formatted by Strings
+func (c *Capabilities) AddString(s string) error {
+	ct, version := s, uint64(0)
+	if i := strings.LastIndexByte(s, '/'); i >= 0 {
+		v, err := strconv.ParseUint(s[i+1:], 10, 32)
+		if err != nil {
+			return fmt.Errorf("bad capability %q", s)
+		}
+		ct, version = s[:i], v
+	}
+	if ct == "" {
+		return fmt.Errorf("bad capability %q", s)
+	}
+	if c.Channels == nil {
+		c.Channels = map[string]uint32{}
+	}
+	c.Channels[ct] = uint32(version)
+	return nil
+}
+
+// capabilitiesMsg is the reply to CapabilitiesRequest
+type capabilitiesMsg struct {
+	Proto    uint32
+	Channels []string
+}
+
+func (c Capabilities) Marshal() []byte {
+	return ssh.Marshal(&capabilitiesMsg{Proto: c.Proto, Channels: c.Strings()})
+}
+
+func ParseCapabilities(b []byte) (Capabilities, error) {
+	msg := capabilitiesMsg{}
+	if err := ssh.Unmarshal(b, &msg); err != nil {
+		return Capabilities{}, fmt.Errorf("malformed capabilities: %w", err)
+	}
+	c := Capabilities{Proto: msg.Proto, Channels: map[string]uint32{}}
+	for _, s := range msg.Channels {
+		if err := c.AddString(s); err != nil {
+			return Capabilities{}, err
+		}
+	}
+	return c, nil
+}
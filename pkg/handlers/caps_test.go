@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestCapabilities(t *testing.T) {
+	h := Handlers{
+		OpenDirect: func(context.Context, ssh.Channel, ChannelOpenDirectMsg) {},
+		FreeForm:   map[string]func(context.Context, ssh.Channel, []byte){"legacy": nil},
+		Channels:   map[string]ChannelHandler{"weyoun": nil, "admin": nil},
+		Versions:   map[string]uint32{"weyoun": 2},
+	}
+	caps := h.Capabilities()
+	want := []string{"admin", "direct-tcpip", "legacy", "weyoun/2"}
+	if got := caps.Strings(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Strings() = %v want %v", got, want)
+	}
+	if !caps.Has("weyoun", 1) || !caps.Has("weyoun", 2) || caps.Has("weyoun", 3) || caps.Has("session", 0) {
+		t.Errorf("Has() wrong for %v", caps.Strings())
+	}
+
+	parsed, err := ParseCapabilities(caps.Marshal())
+	if err != nil {
+		t.Fatalf("ParseCapabilities %v", err)
+	}
+	if !reflect.DeepEqual(parsed, caps) {
+		t.Errorf("ParseCapabilities = %+v want %+v", parsed, caps)
+	}
+
+	h.RemoteForward = &RemoteForward{}
+	caps = h.Capabilities()
+	policy := &Policy{Channels: map[string]ChannelRule{
+		"admin":         {Fingerprints: []string{"SHA256:admin"}},
+		"tcpip-forward": {Fingerprints: []string{"SHA256:admin"}},
+	}}
+	got := caps.Authorized(policy, PeerInfo{Fingerprint: "SHA256:stranger"}).Strings()
+	if want := []string{"direct-tcpip", "legacy", "weyoun/2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Authorized() = %v want %v", got, want)
+	}
+
+	for _, bad := range []string{"", "/1", "weyoun/x"} {
+		if err := (&Capabilities{}).AddString(bad); err == nil {
+			t.Errorf("AddString(%q) succeeded", bad)
+		}
+	}
+}
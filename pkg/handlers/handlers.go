@@ -2,15 +2,47 @@ package handlers
 
 import (
 	"context"
+	"net"
 
 	"golang.org/x/crypto/ssh"
 )
 
+// Handlers are called with a context carrying the PeerInfo of the client,
+// see PeerInfoFromContext
 type Handlers struct {
 	OpenDirect func(ctx context.Context, channel ssh.Channel, msg ChannelOpenDirectMsg) // direct-tcpip
 	FreeForm   map[string]func(ctx context.Context, channel ssh.Channel, extra []byte)
+	// Channels are like FreeForm but also get the channel requests, they
+	// must be read, e.g. with ssh.DiscardRequests, or the connection stalls.
+	// Channels wins over FreeForm for the same type.
+	Channels map[string]ChannelHandler
+	Policy   *Policy // nil lets every authenticated key open every channel
+	// RemoteForward enables tcpip-forward, nil refuses it
+	RemoteForward *RemoteForward
+	// Exec, Shell and Subsystem serve session channels, e.g. from stock
+	// OpenSSH, requests without a handler are refused
+	Exec      SessionHandler
+	Shell     SessionHandler
+	Subsystem map[string]SessionHandler
+	// Global handles connection-level requests by type, ok and reply
+	// are only sent if the client wants a reply. Policy rules named
+	// after the type apply, a denied request gets a false reply.
+	// tcpip-forward and the capabilities request aren't passed here,
+	// keepalive@openssh.com is answered if not overridden.
+	Global map[string]GlobalHandler
+	// Versions are announced with the FreeForm and Channels types, e.g.
+	// client.ProtocolVersion for client.ChannelName()
+	Versions map[string]uint32
 }
 
+// GlobalHandler runs on the connection's request loop so replies keep
+// their order, it must not block: later requests and then channel data
+// of the whole connection wait for it. Slow work belongs in a goroutine
+// after replying.
+type GlobalHandler func(ctx context.Context, peer PeerInfo, payload []byte) (ok bool, reply []byte)
+
+type ChannelHandler func(ctx context.Context, channel ssh.Channel, reqs <-chan *ssh.Request, extra []byte)
+
 // RFC 4254 7.2
 type ChannelOpenDirectMsg struct {
 	Raddr string
@@ -18,3 +50,17 @@ type ChannelOpenDirectMsg struct {
 	Laddr string
 	Lport uint32
 }
+
+// RemoteForward handles tcpip-forward requests, RFC 4254 7.1
+type RemoteForward struct {
+	// Allow decides if the caller in ctx may listen on host:port, nil
+	// leaves the decision to Policy
+	Allow func(ctx context.Context, host string, port uint32) bool
+	// Listen replaces net.Listen, e.g. to listen on a pipenet
+	Listen func(ctx context.Context, addr string) (net.Listener, error)
+	// GatewayPorts lets clients bind the address they ask for. Without
+	// it every forward is bound to loopback like OpenSSH's default
+	// GatewayPorts no, so "", 0.0.0.0 or a LAN address listen on
+	// 127.0.0.1 instead.
+	GatewayPorts bool
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// PeerInfo identifies the authenticated client a handler is serving
+type PeerInfo struct {
+	User          string
+	Fingerprint   string // SHA256 of the key, not the certificate
+	KeyType       string
+	CertKeyID     string   // empty unless a certificate was used
+	Principals    []string // of the certificate
+	RemoteAddr    net.Addr
+	LocalAddr     net.Addr
+	ClientVersion string
+	SessionID     []byte
+	// Extensions are the ssh.Permissions granted by the key or certificate,
+	// authorized_keys options are prefixed with "authorized-keys:"
+	Extensions map[string]string
+}
+
+// NewPeerInfo collects what the handshake established about conn
+func NewPeerInfo(conn *ssh.ServerConn) PeerInfo {
+	info := PeerInfo{
+		User:          conn.User(),
+		RemoteAddr:    conn.RemoteAddr(),
+		LocalAddr:     conn.LocalAddr(),
+		ClientVersion: string(conn.ClientVersion()),
+		SessionID:     conn.SessionID(),
+		Extensions:    map[string]string{},
+	}
+	if conn.Permissions == nil {
+		return info
+	}
+	for k, v := range conn.Permissions.Extensions {
+		info.Extensions[k] = v
+	}
+	info.Fingerprint = info.Extensions["pubkey-fp"]
+	info.KeyType = info.Extensions["pubkey-type"]
+	info.CertKeyID = info.Extensions["cert-key-id"]
+	if principals := info.Extensions["cert-principals"]; principals != "" {
+		info.Principals = strings.Split(principals, ",")
+	}
+	return info
+}
+
+type peerInfoKey struct{}
+
+// WithPeerInfo returns a copy of ctx carrying info
+func WithPeerInfo(ctx context.Context, info PeerInfo) context.Context {
+	return context.WithValue(ctx, peerInfoKey{}, info)
+}
+
+// PeerInfoFromContext returns the PeerInfo of the connection a handler
+// was called for
+func PeerInfoFromContext(ctx context.Context) (PeerInfo, bool) {
+	info, ok := ctx.Value(peerInfoKey{}).(PeerInfo)
+	return info, ok
+}
@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+)
+
+// Policy restricts who may open each channel type, channel types
+// without a rule are open to every authenticated key. The rule for
+// tcpip-forward applies to remote forwarding requests and rules named
+// after Handlers.Global request types to those requests.
+type Policy struct {
+	// Groups name sets of key fingerprints and certificate principals
+	Groups   map[string][]string
+	Channels map[string]ChannelRule
+}
+
+// ChannelRule allows a caller matching any of Fingerprints, Groups or
+// Principals, or every caller when all three are empty
+type ChannelRule struct {
+	Fingerprints []string
+	Groups       []string
+	Principals   []string
+	// Destinations are host:port patterns a direct-tcpip channel may
+	// connect to, the host is a glob and the port a number or *,
+	// empty allows every destination
+	Destinations []string
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Policy) member(group string, peer PeerInfo) bool {
+	for _, m := range p.Groups[group] {
+		if m == peer.Fingerprint || contains(peer.Principals, m) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Policy) allowed(rule ChannelRule, peer PeerInfo) bool {
+	if len(rule.Fingerprints) == 0 && len(rule.Groups) == 0 && len(rule.Principals) == 0 {
+		return true
+	}
+	if peer.Fingerprint != "" && contains(rule.Fingerprints, peer.Fingerprint) {
+		return true
+	}
+	for _, principal := range peer.Principals {
+		if contains(rule.Principals, principal) {
+			return true
+		}
+	}
+	for _, group := range rule.Groups {
+		if p.member(group, peer) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorize returns why peer may not open a channelType channel
+func (p *Policy) Authorize(channelType string, peer PeerInfo) error {
+	if p == nil {
+		return nil
+	}
+	rule, ok := p.Channels[channelType]
+	if !ok {
+		return nil
+	}
+	if !p.allowed(rule, peer) {
+		return fmt.Errorf("%s channels not allowed for %s", channelType, peer.Fingerprint)
+	}
+	return nil
+}
+
+// AuthorizeDirect additionally checks the destination of a direct-tcpip
+// channel
+func (p *Policy) AuthorizeDirect(peer PeerInfo, msg ChannelOpenDirectMsg) error {
+	return p.authorizeDestination("direct-tcpip", peer, msg.Raddr, msg.Rport)
+}
+
+// AuthorizeForward checks a tcpip-forward request against the
+// tcpip-forward rule, its Destinations being the allowed bind addresses
+func (p *Policy) AuthorizeForward(peer PeerInfo, host string, port uint32) error {
+	return p.authorizeDestination("tcpip-forward", peer, host, port)
+}
+
+func (p *Policy) authorizeDestination(channelType string, peer PeerInfo, host string, port uint32) error {
+	if err := p.Authorize(channelType, peer); err != nil {
+		return err
+	}
+	if p == nil {
+		return nil
+	}
+	rule := p.Channels[channelType]
+	if len(rule.Destinations) == 0 {
+		return nil
+	}
+	for _, pattern := range rule.Destinations {
+		if matchDestination(pattern, host, port) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s to %s not allowed", channelType, net.JoinHostPort(host, strconv.Itoa(int(port))))
+}
+
+func matchDestination(pattern, host string, port uint32) bool {
+	patternHost, patternPort, err := net.SplitHostPort(pattern)
+	if err != nil {
+		return false
+	}
+	if patternPort != "*" && patternPort != strconv.Itoa(int(port)) {
+		return false
+	}
+	ok, err := path.Match(patternHost, host)
+	return err == nil && ok
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import "testing"
+
+func TestPolicy(t *testing.T) {
+	policy := &Policy{
+		Groups: map[string][]string{"admins": {"SHA256:admin", "root"}},
+		Channels: map[string]ChannelRule{
+			"admin": {Groups: []string{"admins"}},
+			"direct-tcpip": {
+				Principals:   []string{"alice"},
+				Destinations: []string{"*.internal:443", "localhost:*"},
+			},
+		},
+	}
+	admin := PeerInfo{Fingerprint: "SHA256:admin"}
+	root := PeerInfo{Fingerprint: "SHA256:cert", Principals: []string{"root"}}
+	alice := PeerInfo{Fingerprint: "SHA256:alice", Principals: []string{"alice"}}
+	stranger := PeerInfo{Fingerprint: "SHA256:stranger"}
+
+	testCases := []struct {
+		desc        string
+		channelType string
+		peer        PeerInfo
+		allowed     bool
+	}{
+		{desc: "no rule", channelType: "weyoun", peer: stranger, allowed: true},
+		{desc: "group fingerprint", channelType: "admin", peer: admin, allowed: true},
+		{desc: "group principal", channelType: "admin", peer: root, allowed: true},
+		{desc: "not in group", channelType: "admin", peer: alice},
+		{desc: "principal", channelType: "direct-tcpip", peer: alice, allowed: true},
+		{desc: "no principal", channelType: "direct-tcpip", peer: admin},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			if err := policy.Authorize(tC.channelType, tC.peer); (err == nil) != tC.allowed {
+				t.Fatalf("Authorize() = %v want allowed=%v", err, tC.allowed)
+			}
+		})
+	}
+
+	destinations := []struct {
+		host    string
+		port    uint32
+		allowed bool
+	}{
+		{"git.internal", 443, true},
+		{"git.internal", 22, false},
+		{"localhost", 8080, true},
+		{"example.com", 443, false},
+	}
+	for _, d := range destinations {
+		msg := ChannelOpenDirectMsg{Raddr: d.host, Rport: d.port}
+		if err := policy.AuthorizeDirect(alice, msg); (err == nil) != d.allowed {
+			t.Errorf("AuthorizeDirect(%s:%d) = %v want allowed=%v", d.host, d.port, err, d.allowed)
+		}
+	}
+
+	var open *Policy
+	if err := open.AuthorizeDirect(stranger, ChannelOpenDirectMsg{Raddr: "example.com", Rport: 443}); err != nil {
+		t.Fatalf("nil policy denied %v", err)
+	}
+}
@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+	"jonwillia.ms/weyoun/internal/pipe"
+)
+
+// ProxyPolicy limits the destinations of DirectTCPIPProxy
+type ProxyPolicy struct {
+	// Allow lists the destinations that may be dialed as an address
+	// and optional port. The address is *, an IP or a CIDR and the port
+	// a number, a lo-hi range or *, e.g. 10.0.0.0/8:443 or
+	// [fd00::/8]:8000-8999. Empty allows every destination.
+	Allow       []string
+	DialTimeout time.Duration // 0 uses 10s
+	IdleTimeout time.Duration // closes connections without traffic, 0 never does
+	// Dial replaces net.Dialer, it is given the resolved IP address
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+	// Report is called when a connection ends with the bytes sent to
+	// and received from the destination
+	Report func(ctx context.Context, msg ChannelOpenDirectMsg, sent, received int64, err error)
+}
+
+type allowRule struct {
+	network        *net.IPNet // nil matches any address
+	portLo, portHi int
+}
+
+func parseAllowRule(s string) (allowRule, error) {
+	rule := allowRule{portLo: 0, portHi: 65535}
+	addr, ports := s, "*"
+	switch {
+	case strings.HasPrefix(s, "["):
+		end := strings.Index(s, "]")
+		if end < 0 {
+			return rule, fmt.Errorf("missing ] in %q", s)
+		}
+		addr = s[1:end]
+		if rest := s[end+1:]; rest != "" {
+			if !strings.HasPrefix(rest, ":") {
+				return rule, fmt.Errorf("bad port in %q", s)
+			}
+			ports = rest[1:]
+		}
+	case strings.Count(s, ":") == 1:
+		i := strings.Index(s, ":")
+		addr, ports = s[:i], s[i+1:]
+	}
+
+	switch {
+	case addr == "*":
+	case strings.Contains(addr, "/"):
+		_, network, err := net.ParseCIDR(addr)
+		if err != nil {
+			return rule, err
+		}
+		rule.network = network
+	default:
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return rule, fmt.Errorf("bad address %q", addr)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		rule.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	}
+
+	if ports != "*" {
+		lo, hi := ports, ports
+		if i := strings.Index(ports, "-"); i >= 0 {
+			lo, hi = ports[:i], ports[i+1:]
+		}
+		var err error
+		if rule.portLo, err = strconv.Atoi(lo); err != nil {
+			return rule, fmt.Errorf("bad port in %q", s)
+		}
+		if rule.portHi, err = strconv.Atoi(hi); err != nil {
+			return rule, fmt.Errorf("bad port in %q", s)
+		}
+	}
+	return rule, nil
+}
+
+func (r allowRule) match(ip net.IP, port int) bool {
+	if port < r.portLo || port > r.portHi {
+		return false
+	}
+	return r.network == nil || r.network.Contains(ip)
+}
+
+// DirectTCPIPProxy returns an OpenDirect handler that dials the
+// requested destination and copies between it and the channel. The
+// destination is resolved before it is checked against policy, so a
+// name can't be used to reach an address that isn't allowed. A nil
+// policy allows every destination.
+func DirectTCPIPProxy(policy *ProxyPolicy) func(ctx context.Context, channel ssh.Channel, msg ChannelOpenDirectMsg) {
+	if policy == nil {
+		policy = &ProxyPolicy{}
+	}
+	rules := make([]allowRule, 0, len(policy.Allow))
+	for _, s := range policy.Allow {
+		rule, err := parseAllowRule(s)
+		if err != nil {
+			// a typo must not open the proxy up, so the rule matches nothing
+			log.Error().Err(err).Msg("DirectTCPIPProxy ignoring rule")
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	allowed := func(ip net.IP, port int) bool {
+		if len(policy.Allow) == 0 {
+			return true
+		}
+		for _, rule := range rules {
+			if rule.match(ip, port) {
+				return true
+			}
+		}
+		return false
+	}
+	dialTimeout := policy.DialTimeout
+	if dialTimeout <= 0 {
+		dialTimeout = 10 * time.Second
+	}
+	dial := policy.Dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+
+	return func(ctx context.Context, channel ssh.Channel, msg ChannelOpenDirectMsg) {
+		var sent, received int64
+		err := func() error {
+			dialCtx, cancel := context.WithTimeout(ctx, dialTimeout)
+			defer cancel()
+			addr, err := resolveAllowed(dialCtx, msg, allowed)
+			if err != nil {
+				return err
+			}
+			conn, err := dial(dialCtx, "tcp", addr)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			return proxy(channel, conn, policy.IdleTimeout, &sent, &received)
+		}()
+
+		l := log.Info()
+		if err != nil {
+			l = log.Warn().Err(err)
+		}
+		l.Str("dest", net.JoinHostPort(msg.Raddr, strconv.Itoa(int(msg.Rport)))).
+			Int64("sent", sent).Int64("received", received).Msg("direct-tcpip closed")
+		if policy.Report != nil {
+			policy.Report(ctx, msg, sent, received, err)
+		}
+	}
+}
+
+// resolveAllowed returns the first address of the destination allowed
+func resolveAllowed(ctx context.Context, msg ChannelOpenDirectMsg, allowed func(net.IP, int) bool) (string, error) {
+	port := int(msg.Rport)
+	var ips []net.IP
+	if ip := net.ParseIP(msg.Raddr); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, msg.Raddr)
+		if err != nil {
+			return "", err
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+	for _, ip := range ips {
+		if allowed(ip, port) {
+			return net.JoinHostPort(ip.String(), strconv.Itoa(port)), nil
+		}
+	}
+	return "", fmt.Errorf("destination %s not allowed", net.JoinHostPort(msg.Raddr, strconv.Itoa(port)))
+}
+
+// proxy copies in both directions, passing on half-closes, until both
+// directions are done or nothing was copied for idle
+func proxy(channel ssh.Channel, conn net.Conn, idle time.Duration, sent, received *int64) error {
+	var idled int32
+	activity := func() {}
+	if idle > 0 {
+		timer := time.AfterFunc(idle, func() {
+			atomic.StoreInt32(&idled, 1)
+			channel.Close()
+			conn.Close()
+		})
+		defer timer.Stop()
+		activity = func() { timer.Reset(idle) }
+	}
+
+	// bytes read from the channel were sent by the client
+	err := pipe.Join(
+		&countingConn{ReadWriter: channel, n: sent, activity: activity},
+		&countingConn{ReadWriter: conn, n: received, activity: activity},
+	)
+	if atomic.LoadInt32(&idled) == 1 {
+		return fmt.Errorf("idle for %v", idle)
+	}
+	return err
+}
+
+// countingConn counts the bytes read and passes on CloseWrite for
+// pipe.Join
+type countingConn struct {
+	io.ReadWriter
+	n        *int64
+	activity func()
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriter.Read(p)
+	if n > 0 {
+		c.activity()
+		atomic.AddInt64(c.n, int64(n))
+	}
+	return n, err
+}
+
+func (c *countingConn) CloseWrite() error {
+	if cw, ok := c.ReadWriter.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
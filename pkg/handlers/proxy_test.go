@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestProxyAllow(t *testing.T) {
+	testCases := []struct {
+		rule    string
+		addr    string
+		port    uint32
+		allowed bool
+	}{
+		{rule: "10.0.0.0/8", addr: "10.1.2.3", port: 22, allowed: true},
+		{rule: "10.0.0.0/8", addr: "192.168.1.1", port: 22},
+		{rule: "10.0.0.0/8:443", addr: "10.1.2.3", port: 80},
+		{rule: "192.168.1.5:22", addr: "192.168.1.5", port: 22, allowed: true},
+		{rule: "*:8000-8999", addr: "203.0.113.9", port: 8080, allowed: true},
+		{rule: "*:8000-8999", addr: "203.0.113.9", port: 9000},
+		{rule: "[fd00::/8]:443", addr: "fd12::1", port: 443, allowed: true},
+		{rule: "[::1]", addr: "::1", port: 5432, allowed: true},
+		{rule: "fd00::/8", addr: "fe80::1", port: 443},
+		{rule: "not-an-ip:22", addr: "10.1.2.3", port: 22},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.rule+" "+tC.addr, func(t *testing.T) {
+			rule, err := parseAllowRule(tC.rule)
+			allowed := func(ip net.IP, port int) bool { return err == nil && rule.match(ip, port) }
+			_, err2 := resolveAllowed(context.Background(), ChannelOpenDirectMsg{Raddr: tC.addr, Rport: tC.port}, allowed)
+			if (err2 == nil) != tC.allowed {
+				t.Fatalf("resolveAllowed() = %v want allowed=%v", err2, tC.allowed)
+			}
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"context"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Session is a session channel that asked to exec, start a shell or a
+// subsystem, along with the env and pty-req requests that came first
+type Session struct {
+	ssh.Channel
+	Command string   // exec command or subsystem name, empty for a shell
+	Env     []string // KEY=value
+	Pty     *Pty     // nil unless a pty was requested, no pty is allocated
+	// Requests are the requests that come later, e.g. window-change and
+	// signal, anything not read is refused
+	Requests <-chan *ssh.Request
+}
+
+// RFC 4254 6.2
+type Pty struct {
+	Term          string
+	Columns, Rows uint32
+	Width, Height uint32
+	Modes         string
+}
+
+// SessionHandler serves a Session, the exit status is sent back before
+// the channel is closed
+type SessionHandler func(ctx context.Context, s *Session) (exitStatus uint32)
@@ -0,0 +1,245 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/rs/zerolog/log"
+)
+
+// SFTP shares a directory over the sftp subsystem
+type SFTP struct {
+	Root string
+	// Writers are the fingerprints and certificate principals that may
+	// modify files, everyone else gets read-only access
+	Writers []string
+}
+
+func (c SFTP) writable(peer PeerInfo) bool {
+	for _, w := range c.Writers {
+		if w == peer.Fingerprint || contains(peer.Principals, w) {
+			return true
+		}
+	}
+	return false
+}
+
+// SFTPSubsystem returns a handler for Handlers.Subsystem["sftp"]
+func SFTPSubsystem(c SFTP) SessionHandler {
+	return func(ctx context.Context, s *Session) uint32 {
+		root, err := filepath.EvalSymlinks(c.Root)
+		if err != nil {
+			log.Error().Err(err).Msg("sftp root")
+			return 1
+		}
+		peer, _ := PeerInfoFromContext(ctx)
+		fs := &sftpFS{root: root, writable: c.writable(peer)}
+		server := sftp.NewRequestServer(s, sftp.Handlers{
+			FileGet:  fs,
+			FilePut:  fs,
+			FileCmd:  fs,
+			FileList: fs,
+		})
+		defer server.Close()
+		if err := server.Serve(); err != nil && err != io.EOF {
+			log.Error().Err(err).Str("key", peer.Fingerprint).Msg("sftp")
+			return 1
+		}
+		return 0
+	}
+}
+
+// sftpFS serves the files under root, symlinks leading out of it are
+// treated as missing
+type sftpFS struct {
+	root     string
+	writable bool
+}
+
+// resolve maps an sftp path to the file system, the final element
+// isn't resolved so it may not exist yet or be a symlink for Lstat
+func (fs *sftpFS) resolve(p string) (string, error) {
+	full := filepath.Join(fs.root, filepath.FromSlash(filepath.Clean("/"+p)))
+	if full == fs.root {
+		return full, nil
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(full))
+	if err != nil {
+		return "", err
+	}
+	if dir != fs.root && !strings.HasPrefix(dir, fs.root+string(filepath.Separator)) {
+		return "", os.ErrNotExist
+	}
+	return filepath.Join(dir, filepath.Base(full)), nil
+}
+
+// follow is resolve for operations that follow a final symlink
+func (fs *sftpFS) follow(p string) (string, error) {
+	full, err := fs.resolve(p)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(full)
+	if os.IsNotExist(err) {
+		// creating a file, unless full is a dangling symlink
+		if _, lerr := os.Lstat(full); lerr == nil {
+			return "", os.ErrNotExist
+		}
+		return full, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if resolved != fs.root && !strings.HasPrefix(resolved, fs.root+string(filepath.Separator)) {
+		return "", os.ErrNotExist
+	}
+	return resolved, nil
+}
+
+func (fs *sftpFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	p, err := fs.follow(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (fs *sftpFS) openFlags(r *sftp.Request) int {
+	pflags := r.Pflags()
+	// O_APPEND conflicts with WriteAt, clients send offsets anyway
+	flags := os.O_WRONLY
+	if pflags.Read {
+		flags = os.O_RDWR
+	}
+	if pflags.Creat {
+		flags |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flags |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flags |= os.O_EXCL
+	}
+	return flags
+}
+
+func (fs *sftpFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return fs.OpenFile(r)
+}
+
+func (fs *sftpFS) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	if !fs.writable {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+	p, err := fs.follow(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(p, fs.openFlags(r), 0644)
+}
+
+func (fs *sftpFS) Filecmd(r *sftp.Request) error {
+	if !fs.writable {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	p, err := fs.resolve(r.Filepath)
+	if err != nil {
+		return err
+	}
+	switch r.Method {
+	case "Setstat":
+		if p, err = fs.follow(r.Filepath); err != nil {
+			return err
+		}
+		flags, attrs := r.AttrFlags(), r.Attributes()
+		if flags.Size {
+			if err := os.Truncate(p, int64(attrs.Size)); err != nil {
+				return err
+			}
+		}
+		if flags.Permissions {
+			if err := os.Chmod(p, attrs.FileMode().Perm()); err != nil {
+				return err
+			}
+		}
+		if flags.Acmodtime {
+			if err := os.Chtimes(p, time.Unix(int64(attrs.Atime), 0), time.Unix(int64(attrs.Mtime), 0)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "Rename":
+		target, err := fs.resolve(r.Target)
+		if err != nil {
+			return err
+		}
+		return os.Rename(p, target)
+	case "Rmdir", "Remove":
+		return os.Remove(p)
+	case "Mkdir":
+		return os.Mkdir(p, 0755)
+	}
+	// links could point out of root
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+func (fs *sftpFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		p, err := fs.follow(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		infos, err := f.Readdir(-1)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt(infos), nil
+	case "Stat":
+		p, err := fs.follow(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{info}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+func (fs *sftpFS) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	p, err := fs.resolve(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Lstat(p)
+	if err != nil {
+		return nil, err
+	}
+	return listerAt{info}, nil
+}
+
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(out []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(out, l[offset:])
+	if n < len(out) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+type pipeRWC struct {
+	io.Reader
+	io.WriteCloser
+}
+
+func sftpClient(t *testing.T, fs *sftpFS) *sftp.Client {
+	clientR, serverW := io.Pipe()
+	serverR, clientW := io.Pipe()
+	server := sftp.NewRequestServer(pipeRWC{serverR, serverW}, sftp.Handlers{
+		FileGet:  fs,
+		FilePut:  fs,
+		FileCmd:  fs,
+		FileList: fs,
+	})
+	go server.Serve()
+	client, err := sftp.NewClientPipe(clientR, clientW)
+	if err != nil {
+		t.Fatalf("NewClientPipe %v", err)
+	}
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return client
+}
+
+func TestSFTPRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "weyoun-sftp")
+	if err != nil {
+		t.Fatalf("TempDir %v", err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "share")
+	secret := filepath.Join(dir, "secret")
+	for _, d := range []string{root, secret} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatalf("Mkdir %v", err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "hello"), []byte("hi"), 0644); err != nil {
+		t.Fatalf("WriteFile %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(secret, "key"), []byte("shh"), 0600); err != nil {
+		t.Fatalf("WriteFile %v", err)
+	}
+	if err := os.Symlink(secret, filepath.Join(root, "escape")); err != nil {
+		t.Fatalf("Symlink %v", err)
+	}
+	root, _ = filepath.EvalSymlinks(root)
+
+	readOnly := sftpClient(t, &sftpFS{root: root})
+	f, err := readOnly.Open("/hello")
+	if err != nil {
+		t.Fatalf("Open %v", err)
+	}
+	if b, err := ioutil.ReadAll(f); err != nil || string(b) != "hi" {
+		t.Fatalf("ReadAll %q %v", b, err)
+	}
+	f.Close()
+	for _, p := range []string{"/escape/key", "/../secret/key", "escape/../../secret/key"} {
+		if _, err := readOnly.Open(p); err == nil {
+			t.Errorf("Open(%q) escaped the root", p)
+		}
+	}
+	if _, err := readOnly.Create("/new"); err == nil {
+		t.Error("read-only share created a file")
+	}
+	if err := readOnly.Remove("/hello"); err == nil {
+		t.Error("read-only share removed a file")
+	}
+
+	writable := sftpClient(t, &sftpFS{root: root, writable: true})
+	w, err := writable.Create("/new")
+	if err != nil {
+		t.Fatalf("Create %v", err)
+	}
+	w.Write([]byte("data"))
+	w.Close()
+	if b, err := ioutil.ReadFile(filepath.Join(root, "new")); err != nil || string(b) != "data" {
+		t.Fatalf("ReadFile %q %v", b, err)
+	}
+	if _, err := writable.Create("/escape/key"); err == nil {
+		t.Error("Create through a symlink escaped the root")
+	}
+	infos, err := writable.ReadDir("/")
+	if err != nil || len(infos) != 3 {
+		t.Fatalf("ReadDir %v %v", infos, err)
+	}
+}
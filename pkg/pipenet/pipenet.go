@@ -0,0 +1,230 @@
+// Package pipenet is an in-memory network for hermetic tests. Connections
+// are buffered so both ends of an ssh handshake can write at once, which
+// a bare net.Pipe can't do.
+package pipenet
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var loopback = net.IPv4(127, 0, 0, 1)
+
+// Network routes dials to listeners by port
+type Network struct {
+	mu        sync.Mutex
+	listeners map[int]*Listener
+	nextPort  int
+}
+
+func New() *Network {
+	return &Network{
+		listeners: make(map[int]*Listener),
+		nextPort:  1024,
+	}
+}
+
+func (n *Network) allocPort() int {
+	for {
+		n.nextPort++
+		if _, ok := n.listeners[n.nextPort]; !ok {
+			return n.nextPort
+		}
+	}
+}
+
+// Listen opens a listener on a free port
+func (n *Network) Listen(ctx context.Context) (net.Listener, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	l := &Listener{
+		network: n,
+		addr:    &net.TCPAddr{IP: loopback, Port: n.allocPort()},
+		conns:   make(chan net.Conn),
+		done:    make(chan struct{}),
+	}
+	n.listeners[l.addr.Port] = l
+	return l, nil
+}
+
+// DialContext connects to the listener on the port of addr, the host is ignored
+func (n *Network) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("bad port: %w", err)
+	}
+
+	n.mu.Lock()
+	l, ok := n.listeners[port]
+	localAddr := &net.TCPAddr{IP: loopback, Port: n.allocPort()}
+	n.mu.Unlock()
+	if !ok {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: fmt.Errorf("connection refused")}
+	}
+
+	a, b := newPipe(localAddr, l.addr)
+	select {
+	case l.conns <- b:
+		return a, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: fmt.Errorf("connection refused")}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type Listener struct {
+	network   *Network
+	addr      *net.TCPAddr
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+		l.network.mu.Lock()
+		delete(l.network.listeners, l.addr.Port)
+		l.network.mu.Unlock()
+	})
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr { return l.addr }
+
+// buffer is one direction of a connection
+type buffer struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	buf      bytes.Buffer
+	eof      bool // writer closed
+	closed   bool // reader closed
+	deadline time.Time
+	timer    *time.Timer
+}
+
+func newBuffer() *buffer {
+	b := &buffer{}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *buffer) read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for {
+		switch {
+		case b.closed:
+			return 0, net.ErrClosed
+		case b.buf.Len() > 0:
+			return b.buf.Read(p)
+		case b.eof:
+			return 0, io.EOF
+		case !b.deadline.IsZero() && !time.Now().Before(b.deadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+		b.cond.Wait()
+	}
+}
+
+func (b *buffer) write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.eof || b.closed {
+		return 0, io.ErrClosedPipe
+	}
+	b.cond.Broadcast()
+	return b.buf.Write(p)
+}
+
+func (b *buffer) setDeadline(t time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.deadline = t
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if !t.IsZero() {
+		b.timer = time.AfterFunc(time.Until(t), func() {
+			b.mu.Lock()
+			b.cond.Broadcast()
+			b.mu.Unlock()
+		})
+	}
+	b.cond.Broadcast()
+}
+
+func (b *buffer) close(reader bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if reader {
+		b.closed = true
+	} else {
+		b.eof = true
+	}
+	b.cond.Broadcast()
+}
+
+type conn struct {
+	r, w          *buffer
+	local, remote net.Addr
+}
+
+func newPipe(a, b net.Addr) (net.Conn, net.Conn) {
+	ab, ba := newBuffer(), newBuffer()
+	return &conn{r: ba, w: ab, local: a, remote: b},
+		&conn{r: ab, w: ba, local: b, remote: a}
+}
+
+func (c *conn) Read(p []byte) (int, error)  { return c.r.read(p) }
+func (c *conn) Write(p []byte) (int, error) { return c.w.write(p) }
+
+func (c *conn) Close() error {
+	c.r.close(true)
+	c.w.close(false)
+	return nil
+}
+
+// CloseWrite half closes the connection like *net.TCPConn
+func (c *conn) CloseWrite() error {
+	c.w.close(false)
+	return nil
+}
+
+func (c *conn) LocalAddr() net.Addr  { return c.local }
+func (c *conn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *conn) SetDeadline(t time.Time) error {
+	c.r.setDeadline(t)
+	return nil
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.r.setDeadline(t)
+	return nil
+}
+
+// SetWriteDeadline is a no-op as writes never block
+func (c *conn) SetWriteDeadline(t time.Time) error { return nil }
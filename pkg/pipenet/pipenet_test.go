@@ -0,0 +1,189 @@
+package pipenet
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+const timeout = 2 * time.Second
+
+// pair dials a fresh listener and returns both ends
+func pair(t *testing.T, n *Network) (client, server net.Conn) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	l, err := n.Listen(ctx)
+	if err != nil {
+		t.Fatalf("Listen %v", err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			t.Errorf("Accept %v", err)
+		}
+		accepted <- c
+	}()
+	client, err = n.DialContext(ctx, "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("DialContext %v", err)
+	}
+	return client, <-accepted
+}
+
+func TestDial(t *testing.T) {
+	n := New()
+	client, server := pair(t, n)
+	defer client.Close()
+	defer server.Close()
+
+	if client.RemoteAddr().String() != server.LocalAddr().String() ||
+		server.RemoteAddr().String() != client.LocalAddr().String() {
+		t.Errorf("addresses don't match: client %v->%v server %v->%v",
+			client.LocalAddr(), client.RemoteAddr(), server.LocalAddr(), server.RemoteAddr())
+	}
+	// both ends write before reading, as in an ssh version exchange
+	for _, c := range []net.Conn{client, server} {
+		if _, err := c.Write([]byte("hello")); err != nil {
+			t.Fatalf("Write %v", err)
+		}
+	}
+	for _, c := range []net.Conn{client, server} {
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "hello" {
+			t.Fatalf("ReadFull %q %v", buf, err)
+		}
+	}
+}
+
+func TestDialRefused(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	n := New()
+
+	if _, err := n.DialContext(ctx, "tcp", "127.0.0.1:1"); err == nil {
+		t.Error("dialed a port nobody listens on")
+	}
+	if _, err := n.DialContext(ctx, "tcp", "nonsense"); err == nil {
+		t.Error("dialed an address without a port")
+	}
+
+	l, err := n.Listen(ctx)
+	if err != nil {
+		t.Fatalf("Listen %v", err)
+	}
+	// nobody accepts, the dial waits for ctx
+	dialCtx, dialCancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer dialCancel()
+	if _, err := n.DialContext(dialCtx, "tcp", l.Addr().String()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("DialContext without Accept = %v", err)
+	}
+
+	l.Close()
+	if err := l.Close(); err != nil {
+		t.Errorf("second Close %v", err)
+	}
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept after Close = %v", err)
+	}
+	if _, err := n.DialContext(ctx, "tcp", l.Addr().String()); err == nil {
+		t.Error("dialed a closed listener")
+	}
+}
+
+func TestClose(t *testing.T) {
+	n := New()
+	client, server := pair(t, n)
+
+	client.Write([]byte("last"))
+	client.Close()
+	// what was written before Close is still delivered
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "last" {
+		t.Fatalf("ReadFull %q %v", buf, err)
+	}
+	if _, err := server.Read(buf); err != io.EOF {
+		t.Errorf("Read after peer Close = %v, want EOF", err)
+	}
+	if _, err := server.Write(buf); err == nil {
+		t.Error("Write to a closed peer succeeded")
+	}
+	if _, err := client.Read(buf); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Read after Close = %v", err)
+	}
+	server.Close()
+}
+
+func TestCloseWrite(t *testing.T) {
+	n := New()
+	client, server := pair(t, n)
+	defer client.Close()
+	defer server.Close()
+
+	if err := client.(interface{ CloseWrite() error }).CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite %v", err)
+	}
+	if _, err := server.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read after CloseWrite = %v, want EOF", err)
+	}
+	if _, err := client.Write([]byte("x")); err == nil {
+		t.Error("Write after CloseWrite succeeded")
+	}
+	// the other direction stays open
+	if _, err := server.Write([]byte("reply")); err != nil {
+		t.Fatalf("Write %v", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "reply" {
+		t.Errorf("ReadFull %q %v", buf, err)
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	n := New()
+	client, server := pair(t, n)
+	defer client.Close()
+	defer server.Close()
+
+	buf := make([]byte, 1)
+	client.SetReadDeadline(time.Now().Add(-time.Second))
+	if _, err := client.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read past deadline = %v", err)
+	}
+
+	// a deadline set while blocked wakes the reader
+	read := make(chan error, 1)
+	client.SetDeadline(time.Time{})
+	go func() {
+		_, err := client.Read(buf)
+		read <- err
+	}()
+	client.SetDeadline(time.Now().Add(10 * time.Millisecond))
+	select {
+	case err := <-read:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("blocked Read = %v", err)
+		}
+	case <-time.After(timeout):
+		t.Fatal("deadline didn't wake the reader")
+	}
+
+	// clearing the deadline makes reads wait for data again
+	client.SetReadDeadline(time.Time{})
+	server.Write([]byte("x"))
+	if _, err := client.Read(buf); err != nil || buf[0] != 'x' {
+		t.Errorf("Read after clearing deadline = %q, %v", buf, err)
+	}
+	if err := client.SetWriteDeadline(time.Now().Add(-time.Second)); err != nil {
+		t.Errorf("SetWriteDeadline %v", err)
+	}
+	if _, err := client.Write([]byte("x")); err != nil {
+		t.Errorf("Write ignores deadlines, got %v", err)
+	}
+}
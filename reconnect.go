@@ -0,0 +1,48 @@
+package weyoun
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// ReconnectPolicy controls how a Client redials a peer whose connection dropped
+type ReconnectPolicy struct {
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	Jitter         float64 // fraction of the backoff that is randomized
+	MaxAttempts    int     // 0 retries forever, negative disables reconnects
+	// ConfiguredMaxAttempts replaces MaxAttempts for configured peers,
+	// which discovery won't bring back, so it defaults to retrying forever
+	ConfiguredMaxAttempts int
+}
+
+var DefaultReconnectPolicy = ReconnectPolicy{
+	InitialBackoff: 500 * time.Millisecond,
+	MaxBackoff:     time.Minute,
+	Multiplier:     2,
+	Jitter:         0.2,
+	MaxAttempts:    10,
+}
+
+// Backoff returns how long to wait before the given (zero based) attempt
+func (p ReconnectPolicy) Backoff(attempt int) time.Duration {
+	d := float64(p.InitialBackoff) * math.Pow(p.Multiplier, float64(attempt))
+	if max := float64(p.MaxBackoff); p.MaxBackoff > 0 && d > max {
+		d = max
+	}
+	d += d * p.Jitter * (rand.Float64()*2 - 1)
+	if d < 0 {
+		d = 0
+	}
+	return time.Duration(d)
+}
+
+// GiveUp reports whether no more attempts should be made
+func (p ReconnectPolicy) GiveUp(attempt int) bool {
+	if p.MaxAttempts < 0 {
+		return true
+	}
+	return p.MaxAttempts > 0 && attempt >= p.MaxAttempts
+}
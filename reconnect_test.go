@@ -0,0 +1,126 @@
+package weyoun
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"jonwillia.ms/weyoun/pkg/handlers"
+	"jonwillia.ms/weyoun/pkg/pipenet"
+)
+
+func TestReconnectPolicy(t *testing.T) {
+	policy := ReconnectPolicy{
+		InitialBackoff: time.Second,
+		MaxBackoff:     10 * time.Second,
+		Multiplier:     2,
+		Jitter:         0.5,
+		MaxAttempts:    3,
+	}
+	for attempt, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		got := policy.Backoff(attempt)
+		if got < want/2 || got > want*3/2 {
+			t.Fatalf("Backoff(%d) = %v, want %v ±50%%", attempt, got, want)
+		}
+	}
+	if policy.GiveUp(2) || !policy.GiveUp(3) {
+		t.Fatal("GiveUp should trip at MaxAttempts")
+	}
+	if (ReconnectPolicy{}).GiveUp(1000) {
+		t.Fatal("MaxAttempts 0 should retry forever")
+	}
+	if !(ReconnectPolicy{MaxAttempts: -1}).GiveUp(0) {
+		t.Fatal("negative MaxAttempts should disable reconnects")
+	}
+}
+
+func TestReconnectConfiguredPeer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	network := pipenet.New()
+	static := &Static{Peers: []*Peer{{
+		Instance: "configured",
+		AddrIPv4: []net.IP{net.IPv4(127, 0, 0, 1)},
+		Trusted:  true,
+	}}}
+	// the peer is down for longer than MaxAttempts allows
+	var refused int32
+	dial := func(ctx context.Context, proto, addr string) (net.Conn, error) {
+		if atomic.AddInt32(&refused, 1) <= 4 {
+			return nil, fmt.Errorf("connection refused")
+		}
+		return network.DialContext(ctx, proto, addr)
+	}
+
+	connectPairWith(ctx, t, network, handlers.Handlers{}, func(context.Context, *ssh.Client) {},
+		[]Option{
+			WithListen(func(ctx context.Context) (net.Listener, error) {
+				l, err := network.Listen(ctx)
+				if err == nil {
+					static.Peers[0].Port = l.Addr().(*net.TCPAddr).Port
+				}
+				return l, err
+			}),
+		},
+		[]Option{
+			WithDiscovery(static),
+			WithDial(dial),
+			WithReconnectPolicy(ReconnectPolicy{
+				InitialBackoff: time.Millisecond,
+				MaxBackoff:     10 * time.Millisecond,
+				Multiplier:     2,
+				MaxAttempts:    1,
+			}),
+		},
+	)
+}
+
+func TestReconnectConfiguredPeerGivesUp(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var dials int32
+	dial := func(ctx context.Context, proto, addr string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return nil, fmt.Errorf("connection refused")
+	}
+	static := &Static{Peers: []*Peer{{
+		Instance: "configured",
+		Port:     22,
+		AddrIPv4: []net.IP{net.IPv4(127, 0, 0, 1)},
+		Trusted:  true,
+	}}}
+	c := NewClient("configured", func(ctx context.Context, sshClient *ssh.Client) {
+		t.Error("connected to a peer that refuses every dial")
+	}, func(_ context.Context, _ *ssh.Client) {}, nil,
+		WithDiscovery(static),
+		WithDial(dial),
+		WithReconnectPolicy(ReconnectPolicy{
+			InitialBackoff:        time.Millisecond,
+			MaxBackoff:            time.Millisecond,
+			Multiplier:            1,
+			ConfiguredMaxAttempts: 2,
+		}),
+	)
+	if err := c.Run(ctx); err != nil {
+		t.Fatalf("client.Run %v", err)
+	}
+
+	// the first dial and two reconnects
+	for atomic.LoadInt32(&dials) < 3 {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("only %d dials", atomic.LoadInt32(&dials))
+		case <-time.After(time.Millisecond):
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&dials); n != 3 {
+		t.Fatalf("%d dials, ConfiguredMaxAttempts not honoured", n)
+	}
+}
@@ -0,0 +1,103 @@
+package weyoun
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"jonwillia.ms/weyoun/pkg/client"
+	"jonwillia.ms/weyoun/pkg/handlers"
+	"jonwillia.ms/weyoun/pkg/pipenet"
+)
+
+func TestCall(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	rpc := client.NewServer()
+	rpc.Register("echo", func(ctx context.Context, payload []byte) ([]byte, error) {
+		return payload, nil
+	})
+	rpc.Register("fail", func(ctx context.Context, payload []byte) ([]byte, error) {
+		return nil, fmt.Errorf("no")
+	})
+	slowDone := make(chan error, 1)
+	rpc.Register("slow", func(ctx context.Context, payload []byte) ([]byte, error) {
+		<-ctx.Done()
+		slowDone <- ctx.Err()
+		return nil, ctx.Err()
+	})
+
+	h := handlers.Handlers{
+		FreeForm: map[string]func(context.Context, ssh.Channel, []byte){
+			client.ChannelName(): rpc.Serve,
+		},
+	}
+
+	connectPair(ctx, t, pipenet.New(), h, func(ctx context.Context, sshClient *ssh.Client) {
+		weyoun, err := client.NewClient(sshClient)
+		if err != nil {
+			t.Errorf("client.NewClient %v", err)
+			return
+		}
+		defer weyoun.Close()
+		if v := weyoun.Version(); v != client.ProtocolVersion {
+			t.Errorf("Version = %d want %d", v, client.ProtocolVersion)
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				want := fmt.Sprint(i)
+				got, err := weyoun.Call(ctx, "echo", []byte(want))
+				if err != nil || string(got) != want {
+					t.Errorf("Call echo = %q, %v want %q", got, err, want)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		// frames bigger than the channel window, written from both ends at once
+		big := bytes.Repeat([]byte("x"), 3<<20)
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				got, err := weyoun.Call(ctx, "echo", big)
+				if err != nil || !bytes.Equal(got, big) {
+					t.Errorf("Call echo of %d bytes = %d bytes, %v", len(big), len(got), err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		var remote *client.Error
+		if _, err := weyoun.Call(ctx, "fail", nil); !errors.As(err, &remote) || remote.Message != "no" {
+			t.Errorf("Call fail = %v", err)
+		}
+		if _, err := weyoun.Call(ctx, "missing", nil); !errors.As(err, &remote) {
+			t.Errorf("Call missing = %v", err)
+		}
+
+		callCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		if _, err := weyoun.Call(callCtx, "slow", nil); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Call slow = %v", err)
+		}
+		select {
+		case err := <-slowDone:
+			if err == nil {
+				t.Error("slow handler not cancelled")
+			}
+		case <-ctx.Done():
+			t.Error("slow handler never returned")
+		}
+	})
+}
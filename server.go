@@ -1,13 +1,18 @@
 package weyoun
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"net"
 	"os"
 	"os/user"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
 	"golang.org/x/crypto/ssh"
 	"jonwillia.ms/weyoun/internal/hostkey"
 	"jonwillia.ms/weyoun/internal/server"
@@ -18,10 +23,18 @@ type Server struct {
 	serviceName string
 	handlers    handlers.Handlers
 	id, name    string
+	cfg         Config
+
+	reloadMu sync.Mutex // serializes Reload so an older trust set can't win
+
+	mu       sync.Mutex
+	trust    *trust
+	announce func() error
 }
 
 func NewServer(serviceName string,
 	handlers handlers.Handlers,
+	opts ...Option,
 ) *Server {
 	u, _ := uuid.NewUUID()
 	return &Server{
@@ -29,6 +42,7 @@ func NewServer(serviceName string,
 		handlers:    handlers,
 		id:          u.String(),
 		name:        getName(),
+		cfg:         newConfig(opts),
 	}
 }
 
@@ -49,49 +63,209 @@ func getName() string {
 }
 
 func (s *Server) GetAuthorizedKeys() ([]ssh.PublicKey, error) {
-	return hostkey.GetAuthorizedKeys()
+	return hostkey.GetAuthorizedKeys(s.cfg.KeySource, s.cfg.KeyPolicy)
 }
 
-func (s *Server) Run(ctx context.Context,
-) (err error) {
-	publicKeyCallback, err := hostkey.GetAuthorizedKeysCallback()
+// trust is everything derived from the keys, rebuilt on reload
+type trust struct {
+	config *ssh.ServerConfig
+	signer ssh.Signer
+	// records are the TXT records for the keys without the signature
+	records []string
+	// files were read for this trust set as they were before reading
+	files  []string
+	stamps []fileStamp
+}
+
+// fileStamp is enough of a stat to notice a file was rewritten, zero if
+// it doesn't exist
+type fileStamp struct {
+	modTime int64
+	size    int64
+}
+
+func statFiles(paths []string) []fileStamp {
+	stamps := make([]fileStamp, len(paths))
+	for i, path := range paths {
+		if fi, err := os.Stat(path); err == nil {
+			stamps[i] = fileStamp{fi.ModTime().UnixNano(), fi.Size()}
+		}
+	}
+	return stamps
+}
+
+func equalStamps(a, b []fileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// keyFiles are checked on every handshake so a key removed from
+// authorized_keys or revoked is refused straight away
+func (s *Server) keyFiles() []string {
+	var files []string
+	if path, err := hostkey.AuthorizedKeysPath(); err == nil {
+		files = append(files, path)
+	}
+	if s.cfg.RevocationFile != "" {
+		files = append(files, s.cfg.RevocationFile)
+	}
+	return files
+}
+
+func (s *Server) loadTrust() (*trust, error) {
+	// stat first so a write while we read is seen as a change next time
+	files := s.keyFiles()
+	stamps := statFiles(files)
+	revoked, err := s.cfg.revocations()
+	if err != nil {
+		return nil, err
+	}
+	publicKeyCallback, err := hostkey.GetAuthorizedKeysCallback(s.cfg.KeySource, s.cfg.KeyPolicy, revoked)
 	if err != nil {
-		return fmt.Errorf("can't load authorized keys: %w", err)
+		return nil, fmt.Errorf("can't load authorized keys: %w", err)
 	}
 	// An SSH server is represented by a ServerConfig, which holds
 	// certificate details and handles authentication of ServerConns.
+	// Certificates never reach publicKeyCallback so are checked first.
 	config := &ssh.ServerConfig{
-		PublicKeyCallback: publicKeyCallback,
+		PublicKeyCallback: revoked.UserCallback(s.cfg.CertAuthority.UserCallback(publicKeyCallback)),
 	}
 
-	keys, err := hostkey.Signers()
+	keys, err := hostkey.AllowedSigners(s.cfg.KeySource, s.cfg.KeyPolicy)
 	if err != nil {
-		return fmt.Errorf("can't load host keys: %w", err)
+		return nil, fmt.Errorf("can't load host keys: %w", err)
 	}
 	if len(keys) == 0 {
-		return fmt.Errorf("no available ssh keys for server")
+		return nil, fmt.Errorf("no available ssh keys for server")
 	}
-	for _, key := range keys {
-		// RSA keys are blacklisted because I can't figure out how to
-		// disallow YubiKey keys from my gpg/ssh-agent
-		if key.PublicKey().Type() == "ssh-rsa" {
-			continue
-		}
+	hostKeys, err := s.cfg.CertAuthority.CertSigners(keys, ssh.HostCert)
+	if err != nil {
+		return nil, fmt.Errorf("can't load host certificates: %w", err)
+	}
+	for _, key := range hostKeys {
 		config.AddHostKey(key)
 	}
 
-	authKeys, err := hostkey.GetAuthorizedKeys()
+	authKeys, err := hostkey.GetAuthorizedKeys(s.cfg.KeySource, s.cfg.KeyPolicy)
 	if err != nil {
-		return fmt.Errorf("can't load authorized keys: %w", err)
+		return nil, fmt.Errorf("can't load authorized keys: %w", err)
+	}
+	if len(authKeys) == 0 && (s.cfg.CertAuthority == nil || len(s.cfg.CertAuthority.UserCAs) == 0) {
+		return nil, fmt.Errorf("no available authorized keys for server")
 	}
-	if len(authKeys) == 0 {
-		return fmt.Errorf("no available authorized keys for server")
+	records := append(PublicKeys2TXTRecords(revoked.Filter(authKeys)), textRecord(keyUniq, s.id))
+	records = append(records, Capabilities2TXTRecords(s.handlers.Capabilities())...)
+	if ca := s.cfg.CertAuthority; ca != nil {
+		records = append(records, CAs2TXTRecords(ca.UserCAs)...)
+	}
+
+	return &trust{
+		config: config,
+		// a certificate signer publishes its certificate with the signature
+		signer:  hostKeys[0],
+		records: records,
+		files:   files,
+		stamps:  stamps,
+	}, nil
+}
+
+func (s *Server) currentTrust() *trust {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.trust
+}
+
+// Reload rereads authorized keys and host keys, the next handshake sees
+// the new trust set and the announcement is updated if it changed
+func (s *Server) Reload() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	return s.reload()
+}
+
+func (s *Server) reload() error {
+	t, err := s.loadTrust()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	old, announce := s.trust, s.announce
+	s.trust = t
+	s.mu.Unlock()
+
+	if announce != nil && (old == nil || !equalRecords(old.records, t.records) ||
+		!bytes.Equal(old.signer.PublicKey().Marshal(), t.signer.PublicKey().Marshal())) {
+		log.Info().Msg("keys changed, re-announcing")
+		return announce()
+	}
+	return nil
+}
+
+// serverConfig is the config for a handshake, reloaded first if a key
+// file changed since the trust set was read
+func (s *Server) serverConfig() (*ssh.ServerConfig, error) {
+	t := s.currentTrust()
+	if equalStamps(t.stamps, statFiles(t.files)) {
+		return t.config, nil
+	}
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	// another handshake may have reloaded while we waited
+	if t = s.currentTrust(); equalStamps(t.stamps, statFiles(t.files)) {
+		return t.config, nil
+	}
+	// refuse rather than keep trusting what the files no longer allow
+	if err := s.reload(); err != nil {
+		return nil, fmt.Errorf("key files changed, failed to reload: %w", err)
+	}
+	return s.currentTrust().config, nil
+}
+
+func equalRecords(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// listenPort is the port announced for addr, Config.Listen may return
+// listeners that aren't tcp
+func listenPort(addr net.Addr) (int, error) {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.Port, nil
+	}
+	_, p, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return 0, fmt.Errorf("can't announce listener on %v: %w", addr, err)
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return 0, fmt.Errorf("can't announce listener on %v: bad port %q", addr, p)
+	}
+	return port, nil
+}
+
+func (s *Server) Run(ctx context.Context,
+) (err error) {
+	if err := s.Reload(); err != nil {
+		return err
 	}
 
 	// Once a ServerConfig has been configured, connections can be
 	// accepted.
-	lc := net.ListenConfig{}
-	listener, err := lc.Listen(ctx, "tcp", "")
+	listener, err := s.cfg.listen(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to listen for connection: %w", err)
 	}
@@ -100,18 +274,73 @@ func (s *Server) Run(ctx context.Context,
 		listener.Close()
 	}()
 
-	txtRecords := append(PublicKeys2TXTRecords(authKeys), textRecord(keyUniq, s.id))
-	if err := Register(ctx, s.name, s.serviceName, listener.Addr().(*net.TCPAddr), txtRecords); err != nil {
+	port, err := listenPort(listener.Addr())
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	txtRecords := func() ([]string, error) {
+		t := s.currentTrust()
+		sigRecords, err := SignTXTRecords(t.signer, s.name, port, s.id, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		return append(append([]string{}, t.records...), sigRecords...), nil
+	}
+	records, err := txtRecords()
+	if err != nil {
+		return fmt.Errorf("unable to sign bonjour records: %w", err)
+	}
+	announcement, err := s.cfg.discovery().Announce(ctx, s.name, s.serviceName, port, records)
+	if err != nil {
 		return fmt.Errorf("unable to register bonjour service: %w", err)
-
 	}
+	s.mu.Lock()
+	s.announce = func() error {
+		records, err := txtRecords()
+		if err != nil {
+			return fmt.Errorf("unable to sign bonjour records: %w", err)
+		}
+		announcement.SetText(records)
+		return nil
+	}
+	s.mu.Unlock()
+
+	go func() {
+		// keep the signature fresh so clients can reject stale replays
+		refresh := time.NewTicker(signatureRefresh)
+		defer refresh.Stop()
+		var reload <-chan time.Time
+		if s.cfg.ReloadInterval > 0 {
+			ticker := time.NewTicker(s.cfg.ReloadInterval)
+			defer ticker.Stop()
+			reload = ticker.C
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-refresh.C:
+				s.mu.Lock()
+				announce := s.announce
+				s.mu.Unlock()
+				if err := announce(); err != nil {
+					log.Error().Err(err).Msg("failed to re-sign bonjour records")
+				}
+			case <-reload:
+				// keep the old trust set if the agent or files are briefly unavailable
+				if err := s.Reload(); err != nil {
+					log.Error().Err(err).Msg("failed to reload keys")
+				}
+			}
+		}
+	}()
 
 	sImpl := server.New(
 		listener.Accept,
-		func() (*ssh.ServerConfig, error) {
-			return config, nil
-		},
+		s.serverConfig,
 		s.handlers,
+		s.cfg.UnauthMultiplier,
 	)
 	go sImpl.Start(ctx)
 	return nil
@@ -0,0 +1,186 @@
+package weyoun
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"jonwillia.ms/weyoun/pkg/handlers"
+	"jonwillia.ms/weyoun/pkg/pipenet"
+)
+
+// swapKeys is a KeySource whose keys change under a running Server
+type swapKeys struct {
+	mu      sync.Mutex
+	signers []ssh.Signer
+}
+
+func (s *swapKeys) Signers() ([]ssh.Signer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.signers, nil
+}
+
+func (s *swapKeys) set(signers ...ssh.Signer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.signers = signers
+}
+
+func newSigner(t *testing.T) ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("NewSignerFromKey %v", err)
+	}
+	return signer
+}
+
+// handshake authenticates to peer with signer and hangs up
+func handshake(ctx context.Context, t *testing.T, network *pipenet.Network, peer *Peer, signer ssh.Signer) error {
+	t.Helper()
+	conn, err := network.DialContext(ctx, "tcp", net.JoinHostPort("localhost", strconv.Itoa(peer.Port)))
+	if err != nil {
+		t.Fatalf("Dial %v", err)
+	}
+	defer conn.Close()
+	c, _, _, err := ssh.NewClientConn(conn, "localhost", &ssh.ClientConfig{
+		User:            "pubkey-fp",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err == nil {
+		c.Close()
+	}
+	return err
+}
+
+func TestServerReload(t *testing.T) {
+	const svcName = "reloaded"
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	first, second := newSigner(t), newSigner(t)
+	keys := &swapKeys{}
+	keys.set(first)
+
+	discovery := NewMemoryDiscovery()
+	network := pipenet.New()
+	server := NewServer(svcName, handlers.Handlers{},
+		WithDiscovery(discovery),
+		WithListen(network.Listen),
+		WithKeySource(keys),
+		WithReloadInterval(0),
+	)
+	if err := server.Run(ctx); err != nil {
+		t.Fatalf("server.Run %v", err)
+	}
+	peers, err := discovery.Browse(ctx, svcName)
+	if err != nil {
+		t.Fatalf("Browse %v", err)
+	}
+	expect := func(signer ssh.Signer) *Peer {
+		t.Helper()
+		select {
+		case peer := <-peers:
+			if _, err := VerifyPeer(peer, []ssh.PublicKey{signer.PublicKey()}, nil, time.Now()); err != nil {
+				t.Fatalf("VerifyPeer %v", err)
+			}
+			return peer
+		case <-ctx.Done():
+			t.Fatal("no announcement")
+		}
+		return nil
+	}
+	peer := expect(first)
+	if err := handshake(ctx, t, network, peer, first); err != nil {
+		t.Fatalf("handshake before reload %v", err)
+	}
+
+	keys.set(second)
+	if err := server.Reload(); err != nil {
+		t.Fatalf("Reload %v", err)
+	}
+	peer = expect(second)
+	if err := handshake(ctx, t, network, peer, first); err == nil {
+		t.Fatal("removed key still authorized after reload")
+	}
+	if err := handshake(ctx, t, network, peer, second); err != nil {
+		t.Fatalf("handshake after reload %v", err)
+	}
+}
+
+func TestServerNonTCPListener(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	dir := t.TempDir()
+	server := NewServer("unix", handlers.Handlers{},
+		WithDiscovery(NewMemoryDiscovery()),
+		WithListen(func(ctx context.Context) (net.Listener, error) {
+			lc := net.ListenConfig{}
+			return lc.Listen(ctx, "unix", filepath.Join(dir, "weyoun.sock"))
+		}),
+	)
+	if err := server.Run(ctx); err == nil {
+		t.Fatal("Run announced a unix socket")
+	}
+}
+
+func TestServerRevocationFileChange(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	host, user := newSigner(t), newSigner(t)
+	keys := &swapKeys{}
+	keys.set(host, user)
+	revocationFile := filepath.Join(t.TempDir(), "revoked")
+	if err := ioutil.WriteFile(revocationFile, nil, 0600); err != nil {
+		t.Fatalf("WriteFile %v", err)
+	}
+
+	discovery := NewMemoryDiscovery()
+	network := pipenet.New()
+	server := NewServer("revoked", handlers.Handlers{},
+		WithDiscovery(discovery),
+		WithListen(network.Listen),
+		WithKeySource(keys),
+		WithRevocationFile(revocationFile),
+		WithReloadInterval(0),
+	)
+	if err := server.Run(ctx); err != nil {
+		t.Fatalf("server.Run %v", err)
+	}
+	peers, err := discovery.Browse(ctx, "revoked")
+	if err != nil {
+		t.Fatalf("Browse %v", err)
+	}
+	var peer *Peer
+	select {
+	case peer = <-peers:
+	case <-ctx.Done():
+		t.Fatal("no announcement")
+	}
+	if err := handshake(ctx, t, network, peer, user); err != nil {
+		t.Fatalf("handshake before revocation %v", err)
+	}
+
+	fp := ssh.FingerprintSHA256(user.PublicKey()) + "\n"
+	if err := ioutil.WriteFile(revocationFile, []byte(fp), 0600); err != nil {
+		t.Fatalf("WriteFile %v", err)
+	}
+	if err := handshake(ctx, t, network, peer, user); err == nil {
+		t.Fatal("revoked key authorized without a reload")
+	}
+}
@@ -0,0 +1,75 @@
+package weyoun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"jonwillia.ms/weyoun/pkg/handlers"
+	"jonwillia.ms/weyoun/pkg/pipenet"
+)
+
+func TestSession(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	h := handlers.Handlers{
+		Exec: func(ctx context.Context, s *handlers.Session) uint32 {
+			fmt.Fprintf(s, "%s %s", s.Command, strings.Join(s.Env, ","))
+			if s.Command == "false" {
+				return 1
+			}
+			return 0
+		},
+	}
+
+	connectPair(ctx, t, pipenet.New(), h, func(ctx context.Context, client *ssh.Client) {
+		run := func(cmd string) (string, error) {
+			session, err := client.NewSession()
+			if err != nil {
+				return "", err
+			}
+			defer session.Close()
+			if err := session.Setenv("LANG", "C"); err != nil {
+				return "", err
+			}
+			out, err := session.Output(cmd)
+			return string(out), err
+		}
+
+		if out, err := run("true"); err != nil || out != "true LANG=C" {
+			t.Errorf("run true = %q, %v", out, err)
+		}
+		var exitErr *ssh.ExitError
+		if _, err := run("false"); !errors.As(err, &exitErr) || exitErr.ExitStatus() != 1 {
+			t.Errorf("run false = %v", err)
+		}
+
+		// no Shell handler
+		session, err := client.NewSession()
+		if err != nil {
+			t.Errorf("NewSession %v", err)
+			return
+		}
+		defer session.Close()
+		if err := session.Shell(); err != nil {
+			t.Errorf("Shell %v", err)
+		}
+		if err := session.Wait(); !errors.As(err, &exitErr) {
+			t.Errorf("Wait = %v", err)
+		}
+		// no Subsystem handler
+		session, err = client.NewSession()
+		if err != nil {
+			t.Errorf("NewSession %v", err)
+			return
+		}
+		defer session.Close()
+		if err := session.RequestSubsystem("sftp"); err == nil {
+			t.Error("unknown subsystem accepted")
+		}
+	})
+}
@@ -0,0 +1,12 @@
+package weyoun
+
+import (
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// OpenSFTP starts the sftp subsystem of a weyoun server, see
+// handlers.SFTPSubsystem
+func OpenSFTP(client *ssh.Client) (*sftp.Client, error) {
+	return sftp.NewClient(client)
+}
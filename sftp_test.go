@@ -0,0 +1,57 @@
+package weyoun
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"jonwillia.ms/weyoun/pkg/handlers"
+	"jonwillia.ms/weyoun/pkg/pipenet"
+)
+
+func TestOpenSFTP(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "weyoun-share")
+	if err != nil {
+		t.Fatalf("TempDir %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	userKeys, err := AgentKeys{}.Signers()
+	if err != nil {
+		t.Fatalf("AgentKeys.Signers %v", err)
+	}
+
+	h := handlers.Handlers{
+		Subsystem: map[string]handlers.SessionHandler{
+			"sftp": handlers.SFTPSubsystem(handlers.SFTP{
+				Root:    dir,
+				Writers: []string{ssh.FingerprintSHA256(userKeys[0].PublicKey())},
+			}),
+		},
+	}
+
+	connectPair(ctx, t, pipenet.New(), h, func(ctx context.Context, client *ssh.Client) {
+		sftpClient, err := OpenSFTP(client)
+		if err != nil {
+			t.Errorf("OpenSFTP %v", err)
+			return
+		}
+		defer sftpClient.Close()
+		f, err := sftpClient.Create("/upload")
+		if err != nil {
+			t.Errorf("Create %v", err)
+			return
+		}
+		f.Write([]byte("shared"))
+		f.Close()
+	})
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "upload")); err != nil || string(b) != "shared" {
+		t.Fatalf("ReadFile %q %v", b, err)
+	}
+}
@@ -0,0 +1,196 @@
+package weyoun
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"jonwillia.ms/weyoun/internal/hostkey"
+)
+
+const (
+	keySig     = keyPrefix + "sig"
+	keySigKey  = keyPrefix + "sigkey"
+	keySigTS   = keyPrefix + "ts"
+	keySigCert = keyPrefix + "sigcert"
+
+	// TXT strings are limited to 255 bytes so signatures are split
+	sigChunkSize = 200
+
+	signatureRefresh = 10 * time.Minute
+	signatureMaxAge  = 3 * signatureRefresh
+	signatureMaxSkew = time.Minute
+)
+
+// signedAnnouncement is the message signed by the host key and
+// published alongside the zeroconf service entry
+type signedAnnouncement struct {
+	Instance  string
+	Port      uint32
+	Uniq      string
+	Timestamp uint64
+}
+
+// SignTXTRecords signs the instance name, port, uniq id and timestamp
+// with the host key and returns the TXT records carrying the signature.
+// A certificate signer also publishes its host certificate.
+func SignTXTRecords(signer ssh.Signer, instance string, port int, uniq string, now time.Time) ([]string, error) {
+	msg := signedAnnouncement{
+		Instance:  instance,
+		Port:      uint32(port),
+		Uniq:      uniq,
+		Timestamp: uint64(now.Unix()),
+	}
+	sig, err := signer.Sign(rand.Reader, ssh.Marshal(&msg))
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign announcement: %w", err)
+	}
+	pub := signer.PublicKey()
+	records := []string{}
+	if cert, ok := pub.(*ssh.Certificate); ok {
+		pub = cert.Key
+		records = append(records, chunkRecords(keySigCert, cert.Marshal())...)
+	}
+	records = append(records,
+		textRecord(keySigKey, ssh.FingerprintSHA256(pub)),
+		textRecord(keySigTS, strconv.FormatUint(msg.Timestamp, 10)),
+	)
+	return append(records, chunkRecords(keySig, ssh.Marshal(sig))...), nil
+}
+
+func chunkRecords(k string, b []byte) (records []string) {
+	encoded := base64.RawStdEncoding.EncodeToString(b)
+	for len(encoded) > 0 {
+		n := sigChunkSize
+		if n > len(encoded) {
+			n = len(encoded)
+		}
+		records = append(records, textRecord(k, encoded[:n]))
+		encoded = encoded[n:]
+	}
+	return
+}
+
+// VerifyPeer checks the signed TXT records of peer against the
+// candidate keys, or a host certificate signed by ca, and returns the
+// key that made the signature. A zero now skips the freshness check.
+func VerifyPeer(peer *Peer, keys []ssh.PublicKey, ca *CertAuthority, now time.Time) (ssh.PublicKey, error) {
+	var (
+		sigKey, ts       string
+		encoded, certEnc strings.Builder
+	)
+	for _, s := range peer.Text {
+		bits := strings.SplitN(s, "=", 2)
+		if len(bits) != 2 {
+			continue
+		}
+		k, v := bits[0], bits[1]
+		switch k {
+		case keySig:
+			encoded.WriteString(v)
+		case keySigKey:
+			sigKey = v
+		case keySigCert:
+			certEnc.WriteString(v)
+		case keySigTS:
+			ts = v
+		}
+	}
+	if sigKey == "" || ts == "" || encoded.Len() == 0 {
+		return nil, fmt.Errorf("unsigned service entry")
+	}
+
+	keys = hostkey.FilterKeys(keys, []string{sigKey})
+	if len(keys) == 0 && certEnc.Len() > 0 {
+		key, err := certifiedKey(peer, certEnc.String(), sigKey, ca)
+		if err != nil {
+			return nil, err
+		}
+		keys = []ssh.PublicKey{key}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("unknown signing key %s", sigKey)
+	}
+
+	timestamp, err := strconv.ParseUint(ts, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad timestamp: %w", err)
+	}
+	if signedAt := time.Unix(int64(timestamp), 0); !now.IsZero() {
+		if signedAt.After(now.Add(signatureMaxSkew)) {
+			return nil, fmt.Errorf("signature from the future: %v", signedAt)
+		}
+		if now.Sub(signedAt) > signatureMaxAge {
+			return nil, fmt.Errorf("signature expired: %v", signedAt)
+		}
+	}
+
+	sigBytes, err := base64.RawStdEncoding.DecodeString(encoded.String())
+	if err != nil {
+		return nil, fmt.Errorf("bad signature encoding: %w", err)
+	}
+	sig := new(ssh.Signature)
+	if err := ssh.Unmarshal(sigBytes, sig); err != nil {
+		return nil, fmt.Errorf("bad signature: %w", err)
+	}
+
+	msg := signedAnnouncement{
+		Instance:  peer.Instance,
+		Port:      uint32(peer.Port),
+		Uniq:      uniq(peer.Text),
+		Timestamp: timestamp,
+	}
+	if err := keys[0].Verify(ssh.Marshal(&msg), sig); err != nil {
+		return nil, fmt.Errorf("signature mismatch: %w", err)
+	}
+	return keys[0], nil
+}
+
+func uniq(txt []string) string {
+	prefix := keyUniq + "="
+	for _, s := range txt {
+		if strings.HasPrefix(s, prefix) {
+			return strings.TrimPrefix(s, prefix)
+		}
+	}
+	return ""
+}
+
+// certifiedKey returns the key of a published host certificate signed by ca
+func certifiedKey(peer *Peer, encoded, sigKey string, ca *CertAuthority) (ssh.PublicKey, error) {
+	certBytes, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("bad certificate encoding: %w", err)
+	}
+	key, err := ssh.ParsePublicKey(certBytes)
+	if err != nil {
+		return nil, fmt.Errorf("bad certificate: %w", err)
+	}
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("published key is not a certificate")
+	}
+	if ssh.FingerprintSHA256(cert.Key) != sigKey {
+		return nil, fmt.Errorf("certificate is not for signing key %s", sigKey)
+	}
+	if err := ca.CheckHostCert(cert, hostPrincipals(peer)); err != nil {
+		return nil, err
+	}
+	return cert.Key, nil
+}
+
+// hostPrincipals are the names a peer's host certificate may be issued to
+func hostPrincipals(peer *Peer) []string {
+	principals := []string{peer.Instance}
+	if host := strings.TrimSuffix(peer.HostName, "."); host != "" {
+		principals = append(principals, host)
+		if i := strings.Index(host, "."); i > 0 {
+			principals = append(principals, host[:i])
+		}
+	}
+	return principals
+}
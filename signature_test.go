@@ -0,0 +1,55 @@
+package weyoun
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSignedTXTRecords(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("NewSignerFromKey %v", err)
+	}
+	now := time.Now()
+	records, err := SignTXTRecords(signer, "me@host", 2222, "uniq", now)
+	if err != nil {
+		t.Fatalf("SignTXTRecords %v", err)
+	}
+	keys := []ssh.PublicKey{signer.PublicKey()}
+
+	testCases := []struct {
+		desc    string
+		port    int
+		uniq    string
+		keys    []ssh.PublicKey
+		now     time.Time
+		wantErr bool
+	}{
+		{desc: "valid", port: 2222, uniq: "uniq", keys: keys, now: now},
+		{desc: "wrong port", port: 2223, uniq: "uniq", keys: keys, now: now, wantErr: true},
+		{desc: "wrong uniq", port: 2222, uniq: "other", keys: keys, now: now, wantErr: true},
+		{desc: "unknown key", port: 2222, uniq: "uniq", now: now, wantErr: true},
+		{desc: "expired", port: 2222, uniq: "uniq", keys: keys, now: now.Add(signatureMaxAge + time.Minute), wantErr: true},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			peer := &Peer{
+				Instance: "me@host",
+				Port:     tC.port,
+				Text:     append([]string{textRecord(keyUniq, tC.uniq)}, records...),
+			}
+			_, err := VerifyPeer(peer, tC.keys, nil, tC.now)
+			if (err != nil) != tC.wantErr {
+				t.Fatalf("VerifyPeer err=%v wantErr=%v", err, tC.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package weyoun
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// StaticPeersEnv is the environment variable read by StaticFromEnv
+const StaticPeersEnv = "WEYOUN_PEERS"
+
+// Static is a Discovery backed by a fixed list of peers, for networks
+// where multicast is blocked
+type Static struct {
+	Peers []*Peer
+}
+
+// ParseStatic reads one peer per line formatted as
+//
+//	instance host:port [key=value ...]
+//
+// Blank lines and lines starting with # are ignored.
+func ParseStatic(r io.Reader) (*Static, error) {
+	s := &Static{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: want instance host:port", line)
+		}
+		host, portStr, err := net.SplitHostPort(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: bad port: %w", line, err)
+		}
+		peer := &Peer{
+			Instance: fields[0],
+			Port:     port,
+			Text:     fields[2:],
+			Trusted:  true,
+		}
+		if ip := net.ParseIP(host); ip == nil {
+			peer.HostName = host
+		} else if ip.To4() != nil {
+			peer.AddrIPv4 = []net.IP{ip}
+		} else {
+			peer.AddrIPv6 = []net.IP{ip}
+		}
+		s.Peers = append(s.Peers, peer)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func StaticFromFile(path string) (*Static, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open static peers: %w", err)
+	}
+	defer f.Close()
+	return ParseStatic(f)
+}
+
+// StaticFromEnv parses StaticPeersEnv, entries may also be separated by ;
+func StaticFromEnv() (*Static, error) {
+	return ParseStatic(strings.NewReader(
+		strings.ReplaceAll(os.Getenv(StaticPeersEnv), ";", "\n"),
+	))
+}
+
+// Announce only logs, the peers' static lists must be updated by hand
+func (s *Static) Announce(ctx context.Context, instance, service string, port int, text []string) (Announcement, error) {
+	log.Info().Str("instance", instance).Str("service", service).Int("port", port).
+		Msg("static discovery, not announcing")
+	return staticAnnouncement{}, nil
+}
+
+func (s *Static) Browse(ctx context.Context, service string) (<-chan *Peer, error) {
+	output := make(chan *Peer)
+	go func() {
+		defer close(output)
+		for _, peer := range s.Peers {
+			select {
+			case output <- peer:
+			case <-ctx.Done():
+				return
+			}
+		}
+		<-ctx.Done()
+	}()
+	return output, nil
+}
+
+type staticAnnouncement struct{}
+
+func (staticAnnouncement) SetText([]string) {}
@@ -0,0 +1,51 @@
+package weyoun
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestParseStatic(t *testing.T) {
+	static, err := ParseStatic(strings.NewReader(`
+# comment
+alice@laptop 192.0.2.1:2222 weyoun-uniq=alice
+bob@desktop [fe80::1]:2223
+carol@server carol.example.com:22 weyoun-key=SHA256:abc
+`))
+	if err != nil {
+		t.Fatalf("ParseStatic %v", err)
+	}
+	if len(static.Peers) != 3 {
+		t.Fatalf("len(Peers) != 3: %d", len(static.Peers))
+	}
+	alice, bob, carol := static.Peers[0], static.Peers[1], static.Peers[2]
+	if alice.Port != 2222 || len(alice.AddrIPv4) != 1 || uniq(alice.Text) != "alice" || !alice.Trusted {
+		t.Fatalf("unexpected alice %+v", alice)
+	}
+	if len(bob.AddrIPv6) != 1 {
+		t.Fatalf("unexpected bob %+v", bob)
+	}
+	if carol.HostName != "carol.example.com" || len(parseTextRecord(carol.Text)) != 1 {
+		t.Fatalf("unexpected carol %+v", carol)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	peers, err := static.Browse(ctx, "whatever")
+	if err != nil {
+		t.Fatalf("Browse %v", err)
+	}
+	for i := range static.Peers {
+		if peer := <-peers; peer != static.Peers[i] {
+			t.Fatalf("Browse peer %d = %+v", i, peer)
+		}
+	}
+	cancel()
+	if _, ok := <-peers; ok {
+		t.Fatal("Browse should close on cancel")
+	}
+
+	if _, err := ParseStatic(strings.NewReader("nohost\n")); err == nil {
+		t.Fatal("ParseStatic should reject a line without an address")
+	}
+}
@@ -0,0 +1,137 @@
+package weyoun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"jonwillia.ms/weyoun/pkg/client"
+	"jonwillia.ms/weyoun/pkg/handlers"
+	"jonwillia.ms/weyoun/pkg/pipenet"
+)
+
+func TestStream(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	rpc := client.NewServer()
+	rpc.RegisterStream("tail", func(ctx context.Context, s *client.Stream) error {
+		for i := 0; i < 3; i++ {
+			if err := s.Send([]byte(fmt.Sprint(i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	rpc.RegisterStream("echo", func(ctx context.Context, s *client.Stream) error {
+		for {
+			msg, err := s.Recv()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := s.Send(msg); err != nil {
+				return err
+			}
+		}
+	})
+	rpc.RegisterStream("fail", func(ctx context.Context, s *client.Stream) error {
+		return fmt.Errorf("no")
+	})
+	watchDone := make(chan struct{})
+	rpc.RegisterStream("watch", func(ctx context.Context, s *client.Stream) error {
+		defer close(watchDone)
+		s.Send([]byte("event"))
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	h := handlers.Handlers{
+		Channels: map[string]handlers.ChannelHandler{
+			client.ChannelName(): rpc.ServeChannel,
+		},
+	}
+
+	recvAll := func(s *client.Stream) ([]string, error) {
+		var msgs []string
+		for {
+			msg, err := s.Recv()
+			if err == io.EOF {
+				return msgs, nil
+			}
+			if err != nil {
+				return msgs, err
+			}
+			msgs = append(msgs, string(msg))
+		}
+	}
+
+	connectPair(ctx, t, pipenet.New(), h, func(ctx context.Context, sshClient *ssh.Client) {
+		weyoun, err := client.NewClient(sshClient)
+		if err != nil {
+			t.Errorf("client.NewClient %v", err)
+			return
+		}
+		defer weyoun.Close()
+
+		tail, err := weyoun.Stream(ctx, "tail")
+		if err != nil {
+			t.Errorf("Stream tail %v", err)
+			return
+		}
+		if msgs, err := recvAll(tail); err != nil || fmt.Sprint(msgs) != "[0 1 2]" {
+			t.Errorf("tail = %v, %v", msgs, err)
+		}
+		select {
+		case <-tail.Context().Done():
+		case <-ctx.Done():
+			t.Error("server ending the stream didn't end it for the client")
+		}
+
+		echo, err := weyoun.Stream(ctx, "echo")
+		if err != nil {
+			t.Errorf("Stream echo %v", err)
+			return
+		}
+		echo.Send([]byte("a"))
+		echo.Send([]byte("b"))
+		echo.CloseSend()
+		if msgs, err := recvAll(echo); err != nil || fmt.Sprint(msgs) != "[a b]" {
+			t.Errorf("echo = %v, %v", msgs, err)
+		}
+
+		var remote *client.Error
+		for _, method := range []string{"fail", "missing"} {
+			s, err := weyoun.Stream(ctx, method)
+			if err != nil {
+				t.Errorf("Stream %s %v", method, err)
+				return
+			}
+			if _, err := s.Recv(); !errors.As(err, &remote) {
+				t.Errorf("%s Recv = %v", method, err)
+			}
+		}
+
+		watchCtx, cancelWatch := context.WithCancel(ctx)
+		defer cancelWatch()
+		watch, err := weyoun.Stream(watchCtx, "watch")
+		if err != nil {
+			t.Errorf("Stream watch %v", err)
+			return
+		}
+		if msg, err := watch.Recv(); err != nil || string(msg) != "event" {
+			t.Errorf("watch Recv = %q, %v", msg, err)
+		}
+		cancelWatch()
+		select {
+		case <-watchDone:
+		case <-ctx.Done():
+			t.Error("cancelling the client didn't cancel the server")
+		}
+	})
+}